@@ -11,12 +11,14 @@
         ;;
 
 .hello   DB "Hello, world\n\0"
+hello_len equ $ - hello - 1             ;; the length, without the NULL
 .message DB "This string has its size calculated dynamically!\n\0"
 .goodbye DB "Goodbye, world\n\0"
+goodbye_len equ $ - goodbye - 1
 
         ;; print a string, with a size
         mov rcx, hello
-        mov rdx, 13
+        mov rdx, hello_len
         call print_string
 
         ;; print a string with ZERO size calculation
@@ -32,7 +34,7 @@
 
         ;; print a string with an explicit size
         mov rcx, goodbye
-        mov rdx, 15
+        mov rdx, goodbye_len
         call print_string
 
         ;; exit this script
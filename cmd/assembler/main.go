@@ -1,24 +1,47 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"os"
+	"strings"
 
 	"github.com/skx/assembler/compiler"
 )
 
+// values holds the values of a flag which may be repeated, such as the
+// directories given via `-I`.
+type values []string
+
+// String returns the values, as required by flag.Value.
+func (v *values) String() string {
+	return strings.Join(*v, ",")
+}
+
+// Set adds a value, as required by flag.Value.
+func (v *values) Set(val string) error {
+	*v = append(*v, val)
+	return nil
+}
+
 func main() {
 
+	var includes values
+	var defines values
+	flag.Var(&includes, "I", "A directory to search for included files, may be repeated.")
+	flag.Var(&defines, "D", "Define a name, as NAME or NAME=value, may be repeated.")
+	align := flag.Bool("align", false, "Align data to the size of each value.")
+	flag.Parse()
+
 	//
 	// Ensure we have an argument
 	//
-	if len(os.Args) <= 1 {
-		fmt.Printf("Usage: compiler input.asm\n")
+	if flag.NArg() != 1 {
+		fmt.Printf("Usage: compiler [-align] [-I dir] [-D NAME=value] input.asm\n")
 		return
 	}
 
-	data, err := ioutil.ReadFile(os.Args[1])
+	data, err := ioutil.ReadFile(flag.Arg(0))
 	if err != nil {
 		fmt.Printf("error:%s\n", err.Error())
 		return
@@ -27,6 +50,23 @@ func main() {
 	// Create the compiler
 	c := compiler.New(string(data))
 
+	c.SetFilename(flag.Arg(0))
+	for _, dir := range includes {
+		c.AddIncludePath(dir)
+	}
+	for _, def := range defines {
+		name, value := def, ""
+		if n := strings.Index(def, "="); n >= 0 {
+			name, value = def[:n], def[n+1:]
+		}
+		err = c.Define(name, value)
+		if err != nil {
+			fmt.Printf("error:%s\n", err.Error())
+			return
+		}
+	}
+
+	c.SetAlignData(*align)
 	c.SetOutput("./a.out")
 
 	err = c.Compile()
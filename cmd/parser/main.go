@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/skx/assembler/parser"
+	"github.com/skx/assembler/preprocessor"
 )
 
 func main() {
@@ -23,7 +24,11 @@ func main() {
 		return
 	}
 
-	p := parser.New(string(data))
+	// Included files are found relative to the input.
+	pre := preprocessor.New()
+	pre.SetFile(os.Args[1])
+
+	p := parser.NewWithPreprocessor(string(data), pre)
 
 	stmt := p.Next()
 	for stmt != nil {
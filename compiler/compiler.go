@@ -7,16 +7,24 @@ package compiler
 import (
 	"encoding/binary"
 	"fmt"
-	"strconv"
 
 	"github.com/skx/assembler/elf"
+	"github.com/skx/assembler/expr"
 	"github.com/skx/assembler/parser"
+	"github.com/skx/assembler/preprocessor"
 	"github.com/skx/assembler/token"
 )
 
 // Compiler holds our state
 type Compiler struct {
 
+	// src holds the program we're compiling.
+	src string
+
+	// pre holds the preprocessor which handles the directives
+	// within our program.
+	pre *preprocessor.Preprocessor
+
 	// p holds the parser we use to generate AST
 	p *parser.Parser
 
@@ -26,46 +34,177 @@ type Compiler struct {
 	// code contains the code we generate
 	code []byte
 
-	// data is where we place constant-strings, etc.
-	data []byte
+	// sections holds the sections, other than the code, in the order
+	// in which they were first used.
+	sections []*section
 
-	// map of "data-name" to "data-offset"
-	dataOffsets map[string]int
-
-	// patches we have to make, post-compilation.  Don't ask
-	patches map[int]int
+	// map of "data-name" to the section, and offset, holding it.
+	offsets map[string]location
 
 	// labels and the corresponding offsets we've seen.
 	labels map[string]int
 
-	// offsets which contain jumps to labels
-	labelTargets map[int]string
-
 	// 8-bit offsets for relative label-jumps
 	jmps map[int]string
 
 	// 32-bit offsets for calls
 	calls map[int]string
+
+	// sources holds the location, within the source, of each jump
+	// and call, so that errors may be reported against them.
+	sources map[int]string
+
+	// values which refer to labels, or data, which need to be
+	// patched once we know where everything is located.
+	fixups []fixup
+
+	// constants holds the named constants which have been defined
+	// via `equ`.
+	constants map[string]expr.Expression
+
+	// evaluating holds the names of the constants we're calculating,
+	// so that we can detect circular definitions.
+	evaluating map[string]bool
+
+	// section is the section we're currently adding to, which is nil
+	// for the code.
+	section *section
+
+	// entry holds the name of the label at which execution begins,
+	// as set via `entry`.
+	entry string
+
+	// globals holds the names of the labels declared via `global`.
+	//
+	// If `_start` is global, and no entry has been given, then
+	// execution begins there.
+	globals map[string]bool
+
+	// pending holds an alignment which will be applied to the
+	// section of the next statement, if the program hasn't chosen
+	// its sections explicitly.
+	pending *alignment
+
+	// alignData is true if data, and reserved storage, should be
+	// aligned to the size of each value.
+	alignData bool
+
+	// explicit is true once the program has used `section`, after
+	// which everything is placed in the current section.  Until then
+	// data is placed in `.data`, reservations in `.bss`, and everything
+	// else in `.text`.
+	explicit bool
+}
+
+// section holds the contents of a section of our program, other than
+// the code.
+type section struct {
+
+	// name is the name of the section, for example ".data".
+	name string
+
+	// kind is the kind of section, which determines where it is
+	// placed, either "rodata", "data", or "bss".
+	kind string
+
+	// contents holds the contents of the section.
+	contents []byte
+
+	// size holds the size of a bss section, which has no contents
+	// as it is zero-filled and isn't written to the binary.
+	size int
+
+	// align is the largest alignment used within the section, which
+	// its start-address must be a multiple of.
+	align int
+}
+
+// length returns the current size of the section.
+func (s *section) length() int {
+	if s.kind == "bss" {
+		return s.size
+	}
+	return len(s.contents)
+}
+
+// reserve adds the given number of zero bytes to the section.
+func (s *section) reserve(n int) {
+	if s.kind == "bss" {
+		s.size += n
+		return
+	}
+	s.contents = append(s.contents, make([]byte, n)...)
+}
+
+// alignment holds an alignment which has yet to be applied.
+type alignment struct {
+	boundary int
+	zero     bool
+}
+
+// location holds the position of some data.
+type location struct {
+	section *section
+	offset  int
+}
+
+// fixup records a value which refers to labels, or data, which must be
+// patched once the program has been compiled and all the addresses
+// are known.
+type fixup struct {
+
+	// offset is the position within the code, or data, where the
+	// value is stored.
+	offset int
+
+	// section is the section in which the value is stored, which is
+	// nil for the code.
+	section *section
+
+	// value is the expression we must calculate.
+	value expr.Expression
+
+	// bits is the size of the value, and extended is true if it
+	// will be sign-extended by the processor.
+	bits     int
+	extended bool
+
+	// relative is true if the reference is relative to the address
+	// of the next instruction (i.e. `rip`), rather than absolute.
+	relative bool
+
+	// next holds the offset of the next instruction, which is used
+	// to calculate relative references.
+	next int
+
+	// location holds the location, within the source, of the
+	// statement which contains the value.
+	location string
 }
 
 // New creates a new instance of the compiler
 func New(src string) *Compiler {
 
-	c := &Compiler{p: parser.New(src), output: "a.out"}
-	c.dataOffsets = make(map[string]int)
-	c.patches = make(map[int]int)
+	c := &Compiler{src: src, pre: preprocessor.New(), output: "a.out"}
+	c.offsets = make(map[string]location)
+	c.globals = make(map[string]bool)
 
 	// mapping of "label -> XXX"
 	c.labels = make(map[string]int)
 
-	// fixups we need to make offset-of-code -> label
-	c.labelTargets = make(map[int]string)
-
 	// jump-fixups
 	c.jmps = make(map[int]string)
 
 	// call-fixups
 	c.calls = make(map[int]string)
+	c.sources = make(map[int]string)
+
+	// constants
+	c.constants = make(map[string]expr.Expression)
+	c.evaluating = make(map[string]bool)
+
+	// The start of the code, for `$$`.
+	c.labels[".text"] = 0
 
 	return c
 }
@@ -77,106 +216,85 @@ func (c *Compiler) SetOutput(path string) {
 	c.output = path
 }
 
+// SetAlignData causes data, and reserved storage, to be aligned to the
+// size of each value, so `DD` values are aligned to four bytes, and `DQ`
+// values to eight.
+func (c *Compiler) SetAlignData(align bool) {
+	c.alignData = align
+}
+
+// SetFilename records the path to the program we're compiling, so that
+// the files it includes may be found relative to it.
+func (c *Compiler) SetFilename(path string) {
+	c.pre.SetFile(path)
+}
+
+// AddIncludePath adds a directory to search for the files given to
+// `%include`.
+func (c *Compiler) AddIncludePath(dir string) {
+	c.pre.AddIncludePath(dir)
+}
+
+// Define defines a name, as if via `%define`, which may be used by the
+// program we're compiling.
+func (c *Compiler) Define(name string, value string) error {
+	return c.pre.Define(name, value)
+}
+
 // Compile walks over the parser-generated AST and assembles the source
 // program.
 //
 // Once the program has been completed an ELF executable will be produced
 func (c *Compiler) Compile() error {
 
+	c.p = parser.NewWithPreprocessor(c.src, c.pre)
+
 	//
 	// Walk over the parser-output
 	//
 	stmt := c.p.Next()
 	for stmt != nil {
 
-		switch stmt := stmt.(type) {
-
-		case parser.Data:
-			c.handleData(stmt)
-
-		case parser.Error:
-			return fmt.Errorf("error compiling - parser returned error %s", stmt.Value)
-
-		case parser.Label:
-			// So now we know the label with the given name
-			// corresponds to the CURRENT position in the
-			// generated binary-code.
-			//
-			// If anything refers to this we'll have to patch
-			// it up
-			c.labels[stmt.Name] = len(c.code)
+		err := c.compileNode(stmt)
+		if err != nil {
 
-		case parser.Instruction:
-			err := c.compileInstruction(stmt)
-			if err != nil {
+			// Errors from the parser include their location.
+			if _, ok := stmt.(parser.Error); ok {
 				return err
 			}
-
-		default:
-			return fmt.Errorf("unhandled node-type %v", stmt)
+			return fmt.Errorf("%s: %s", c.p.Location(), err)
 		}
 
 		stmt = c.p.Next()
 	}
 
-	//
-	// Apply data-patches.
-	//
-	// This is horrid.
-	//
-	for o, v := range c.patches {
-
-		// start of virtual sectoin
-		//  + offset
-		//  + len of code segment
-		//  + elf header
-		//  + 2 * program header
-		// life is hard
-		v = 0x400000 + v + len(c.code) + 0x40 + (2 * 0x38)
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(v))
-
-		for i, x := range buf {
-			c.code[i+o] = x
-		}
-	}
-
-	//
-	// OK now we need to patch references to labels
-	//
-	for o, s := range c.labelTargets {
-
-		offset := c.labels[s]
-
-		offset = 0x400000 + offset + 0x40 + (2 * 0x38)
-
-		// So we have a new offset.
-
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(offset))
-
-		for i, x := range buf {
-			c.code[i+o] = x
-		}
-	}
-
 	// Patchup the jumps
 	for o, s := range c.jmps {
 
 		// the offset of the instruction to we should jump to
-		offset := c.labels[s]
+		offset, ok := c.labels[s]
+		if !ok {
+			return fmt.Errorf("%s: jump to unknown label: %s", c.sources[o], s)
+		}
 
-		// the offset of the position is a byte
-		diff := uint(o - offset)
+		// the displacement is relative to the end of the
+		// instruction, and must fit in a byte.
+		diff := offset - (o + 1)
+		if diff < -128 || diff > 127 {
+			return fmt.Errorf("%s: jump to %s is out of range, %d bytes away", c.sources[o], s, diff)
+		}
 
-		c.code[o] = byte(0xff - byte(diff))
+		c.code[o] = byte(diff)
 	}
 
 	// Patchup the calls
 	for o, s := range c.calls {
 
 		// the offset of the instruction to which we should call
-		offset := c.labels[s]
+		offset, ok := c.labels[s]
+		if !ok {
+			return fmt.Errorf("%s: call to unknown label: %s", c.sources[o], s)
+		}
 
 		// the offset of the position is a byte
 		diff := uint32(o - offset + 4)
@@ -191,11 +309,48 @@ func (c *Compiler) Compile() error {
 		}
 	}
 
+	// Patchup the references to labels, or data.
+	for _, f := range c.fixups {
+
+		val, err := expr.Evaluate(f.value, c.lookup)
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.location, err)
+		}
+
+		if f.relative {
+			val -= c.address(nil) + int64(f.next)
+		}
+
+		buf, err := c.immediate(val, f.bits, f.extended)
+		if err != nil && f.section != nil {
+			return fmt.Errorf("%s: error calculating %s: value %d does not fit in %d bits of data", f.location, f.value, val, f.bits)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: error calculating %s: %s", f.location, f.value, err)
+		}
+
+		if f.section != nil {
+			copy(f.section.contents[f.offset:], buf)
+		} else {
+			copy(c.code[f.offset:], buf)
+		}
+	}
+
 	//
 	// Write.  The.  Elf.  Output.
 	//
 	e := elf.New()
-	err := e.WriteContent(c.output, c.code, c.data)
+	if c.entry == "" && c.globals["_start"] {
+		c.entry = "_start"
+	}
+	if c.entry != "" {
+		offset, ok := c.labels[c.entry]
+		if !ok {
+			return fmt.Errorf("entry point %s is not a label within the code", c.entry)
+		}
+		e.SetEntry(uint64(c.address(nil) + int64(offset)))
+	}
+	err := e.WriteContent(c.output, c.code, c.contents("rodata"), c.contents("data"), c.size("bss"))
 	if err != nil {
 		return fmt.Errorf("error writing elf: %s", err.Error())
 	}
@@ -204,29 +359,540 @@ func (c *Compiler) Compile() error {
 
 }
 
-// handleData appends the data to the data-section of our binary,
+// lookup returns the value of the given constant, or the virtual
+// address of the given label, or data.
+//
+// This may only be called once the program has been compiled.
+func (c *Compiler) lookup(name string) (int64, error) {
+
+	// labels are in the code-section
+	offset, ok := c.labels[name]
+	if ok {
+		return c.address(nil) + int64(offset), nil
+	}
+
+	// data is within one of the other sections
+	loc, ok := c.offsets[name]
+	if ok {
+		return c.address(loc.section) + int64(loc.offset), nil
+	}
+
+	return c.evaluateConstant(name, c.lookup)
+}
+
+// address returns the virtual address of the start of the given section,
+// or of the code if it is nil.
+func (c *Compiler) address(s *section) int64 {
+
+	if s == nil {
+		text, _, _, _ := elf.Addresses(0, 0, 0)
+		return int64(text)
+	}
+
+	addrs, _ := c.layout()
+	return addrs[s]
+}
+
+// layout returns the address of each section, other than the code, and of
+// the start of each kind of section.
+//
+// Sections of each kind are placed one after another, in the order in
+// which they were first used, and each begins at a multiple of its
+// alignment.
+func (c *Compiler) layout() (map[*section]int64, map[string]int64) {
+
+	addrs := make(map[*section]int64)
+	starts := make(map[string]int64)
+	sizes := make(map[string]int)
+
+	for _, kind := range []string{"rodata", "data", "bss"} {
+
+		_, rodata, data, bss := elf.Addresses(len(c.code), sizes["rodata"], sizes["data"])
+		start := map[string]uint64{"rodata": rodata, "data": data, "bss": bss}[kind]
+
+		addr := int64(start)
+		for _, s := range c.sections {
+			if s.kind == kind {
+				addr += padding(addr, s.align)
+				addrs[s] = addr
+				addr += int64(s.length())
+			}
+		}
+
+		starts[kind] = int64(start)
+		sizes[kind] = int(addr - int64(start))
+	}
+	return addrs, starts
+}
+
+// contents returns the contents of all the sections of the given kind,
+// including any padding between them.
+func (c *Compiler) contents(kind string) []byte {
+
+	addrs, starts := c.layout()
+
+	var out []byte
+	for _, s := range c.sections {
+		if s.kind == kind {
+			out = append(out, make([]byte, int(addrs[s]-starts[kind])-len(out))...)
+			out = append(out, s.contents...)
+		}
+	}
+	return out
+}
+
+// size returns the size of all the sections of the given kind, including
+// any padding between them.
+func (c *Compiler) size(kind string) int {
+
+	addrs, starts := c.layout()
+
+	size := 0
+	for _, s := range c.sections {
+		if s.kind == kind {
+			size = int(addrs[s]-starts[kind]) + s.length()
+		}
+	}
+	return size
+}
+
+// padding returns the number of bytes which must be added to the given
+// value to make it a multiple of the given alignment.
+func padding(value int64, align int) int64 {
+	if align <= 1 {
+		return 0
+	}
+	return (int64(align) - value%int64(align)) % int64(align)
+}
+
+// nops returns a series of NOP instructions which is n bytes long, using
+// the recommended multi-byte forms.
+func nops(n int64) []byte {
+
+	forms := [][]byte{
+		{0x90},
+		{0x66, 0x90},
+		{0x0f, 0x1f, 0x00},
+		{0x0f, 0x1f, 0x40, 0x00},
+		{0x0f, 0x1f, 0x44, 0x00, 0x00},
+		{0x66, 0x0f, 0x1f, 0x44, 0x00, 0x00},
+		{0x0f, 0x1f, 0x80, 0x00, 0x00, 0x00, 0x00},
+		{0x0f, 0x1f, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x66, 0x0f, 0x1f, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00},
+	}
+
+	var out []byte
+	for n > 0 {
+		form := forms[len(forms)-1]
+		if n < int64(len(form)) {
+			form = forms[n-1]
+		}
+		out = append(out, form...)
+		n -= int64(len(form))
+	}
+	return out
+}
+
+// align pads the current section so that the position is a multiple of
+// the given boundary.  Code is padded with NOP instructions, unless zero
+// is true, and everything else with zeros.
+func (c *Compiler) align(boundary int, zero bool) {
+
+	if c.section == nil {
+		n := padding(c.address(nil)+int64(len(c.code)), boundary)
+		if zero {
+			c.code = append(c.code, make([]byte, n)...)
+		} else {
+			c.code = append(c.code, nops(n)...)
+		}
+		return
+	}
+
+	// The section must begin at a suitable address too
+	if boundary > c.section.align {
+		c.section.align = boundary
+	}
+	c.section.reserve(int(padding(int64(c.section.length()), boundary)))
+}
+
+// find returns the section with the given name, creating it if this is
+// the first time it has been used.
+//
+// The names `.rodata` and `.bss` have their usual meaning, and every
+// other name is writable data.  The code, `.text`, is nil.
+func (c *Compiler) find(name string) *section {
+
+	if name == ".text" {
+		return nil
+	}
+
+	for _, s := range c.sections {
+		if s.name == name {
+			return s
+		}
+	}
+
+	s := &section{name: name, kind: "data"}
+	switch name {
+	case ".rodata":
+		s.kind = "rodata"
+	case ".bss":
+		s.kind = "bss"
+	}
+	c.sections = append(c.sections, s)
+
+	// The start of the section, for `$$`.
+	c.offsets[name] = location{section: s}
+	return s
+}
+
+// enter switches to the given section, unless the program has chosen its
+// sections explicitly, and applies any pending alignment to it.
+func (c *Compiler) enter(name string) {
+	if c.explicit {
+		return
+	}
+
+	c.section = c.find(name)
+	if c.pending != nil {
+		c.align(c.pending.boundary, c.pending.zero)
+		c.pending = nil
+	}
+}
+
+// define records that the given name refers to the current position.
+func (c *Compiler) define(name string) {
+	if c.section == nil {
+		c.labels[name] = len(c.code)
+		return
+	}
+	c.offsets[name] = location{section: c.section, offset: c.section.length()}
+}
+
+// constantValue returns the value of the given constant, if it can be
+// calculated before the program has been laid out.
+func (c *Compiler) constantValue(name string) (int64, error) {
+	return c.evaluateConstant(name, c.constantValue)
+}
+
+// evaluateConstant returns the value of the named constant, using the
+// given function to find the value of any symbols it refers to.
+func (c *Compiler) evaluateConstant(name string, lookup func(string) (int64, error)) (int64, error) {
+
+	val, ok := c.constants[name]
+	if !ok {
+		return 0, fmt.Errorf("reference to unknown label/data: %s", name)
+	}
+
+	if c.evaluating[name] {
+		return 0, fmt.Errorf("circular definition of constant %s", name)
+	}
+	c.evaluating[name] = true
+	defer delete(c.evaluating, name)
+
+	return expr.Evaluate(val, lookup)
+}
+
+// locate replaces any references to the current location, `$`, and to
+// the start of the current section, `$$`, within the given expression.
+func (c *Compiler) locate(e expr.Expression) expr.Expression {
+
+	return expr.Replace(e, func(s expr.Symbol) expr.Expression {
+		switch s.Name {
+		case "$":
+			return expr.Symbol{Name: c.here()}
+		case "$$":
+			if c.section == nil {
+				return expr.Symbol{Name: ".text"}
+			}
+			return expr.Symbol{Name: c.section.name}
+		}
+		return s
+	})
+}
+
+// here records the current location, as either a label or data,
+// and returns its name.
+//
+// The names we use begin with the name of the section, which begins
+// with ".", so they cannot clash with any names given in the source.
+func (c *Compiler) here() string {
+
+	name := fmt.Sprintf(".text.%d", len(c.code))
+	if c.section != nil {
+		name = fmt.Sprintf("%s.%d", c.section.name, c.section.length())
+	}
+	c.define(name)
+	return name
+}
+
+// compileNode handles a single statement from our parser.
+func (c *Compiler) compileNode(stmt parser.Node) error {
+
+	switch stmt := stmt.(type) {
+
+	case parser.Constant:
+		if _, ok := c.constants[stmt.Name]; ok {
+			return fmt.Errorf("constant %s is already defined", stmt.Name)
+		}
+		c.constants[stmt.Name] = c.locate(stmt.Value)
+
+	case parser.Data:
+		c.enter(".data")
+		err := c.handleData(stmt)
+		if err != nil {
+			return err
+		}
+
+	case parser.Align:
+		boundary, err := expr.Evaluate(c.locate(stmt.Boundary), c.lookup)
+		if err != nil {
+			return fmt.Errorf("failed to calculate boundary for alignment: %s", err)
+		}
+		if boundary < 1 || boundary&(boundary-1) != 0 {
+			return fmt.Errorf("alignment must be a power of two: %d", boundary)
+		}
+
+		// Without sections we don't know where the alignment
+		// applies until we see the next statement.
+		if !c.explicit {
+			c.pending = &alignment{boundary: int(boundary), zero: stmt.Zero}
+			break
+		}
+		c.align(int(boundary), stmt.Zero)
+
+	case parser.Entry:
+		if c.entry != "" {
+			return fmt.Errorf("entry point is already set to %s", c.entry)
+		}
+		c.entry = stmt.Name
+
+	case parser.Global:
+		for _, name := range stmt.Names {
+			c.globals[name] = true
+		}
+
+	case parser.Error:
+		return fmt.Errorf("error compiling - parser returned error %s", stmt.Value)
+
+	case parser.Label:
+		// So now we know the label with the given name
+		// corresponds to the CURRENT position in the
+		// generated binary-code.
+		//
+		// If anything refers to this we'll have to patch
+		// it up
+		c.enter(".text")
+		c.define(stmt.Name)
+
+	case parser.Instruction:
+		c.enter(".text")
+		if c.section != nil {
+			return fmt.Errorf("instructions cannot be placed in the %s section", c.section.name)
+		}
+		fixups := len(c.fixups)
+
+		err := c.compileInstruction(stmt)
+		if err != nil {
+			return err
+		}
+
+		// Relative references are relative to the
+		// end of the instruction which contains them.
+		for n := fixups; n < len(c.fixups); n++ {
+			c.fixups[n].next = len(c.code)
+		}
+
+	case parser.Reserve:
+		c.enter(".bss")
+		err := c.handleReserve(stmt)
+		if err != nil {
+			return err
+		}
+
+	case parser.Section:
+		c.explicit = true
+		c.section = c.find(stmt.Name)
+
+	case parser.Times:
+		err := c.handleTimes(stmt)
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unhandled node-type %v", stmt)
+	}
+
+	return nil
+}
+
+// handleTimes handles an instruction, or data-statement, which is repeated.
+//
+// The count is calculated at the start of the first repetition, so that
+// `$` may be used within it, but it must not refer to anything which
+// has not been defined yet.
+func (c *Compiler) handleTimes(t parser.Times) error {
+
+	if _, ok := t.Statement.(parser.Data); ok {
+		c.enter(".data")
+	} else {
+		c.enter(".text")
+	}
+
+	count, err := expr.Evaluate(c.locate(t.Count), c.lookup)
+	if err != nil {
+		return fmt.Errorf("failed to calculate count for times: %s", err)
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid count for times: %d", count)
+	}
+
+	// Named data is defined even if it is empty.
+	if d, ok := t.Statement.(parser.Data); ok && d.Name != "" && count == 0 {
+		c.define(d.Name)
+	}
+
+	for n := int64(0); n < count; n++ {
+
+		stmt := t.Statement
+		switch s := stmt.(type) {
+
+		// The data is only named once.
+		case parser.Data:
+			if n > 0 {
+				s.Name = ""
+			}
+			stmt = s
+
+		// Each instruction needs its own operands, as they
+		// are updated when `$` is located.
+		case parser.Instruction:
+			s.Operands = append([]parser.Operand(nil), s.Operands...)
+			stmt = s
+		}
+
+		err = c.compileNode(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleReserve reserves uninitialised storage, normally in the bss, and
+// stores the offset appropriately.
+//
+// As with `times` the count must not refer to anything which has not
+// been defined yet.
+func (c *Compiler) handleReserve(r parser.Reserve) error {
+
+	count, err := expr.Evaluate(c.locate(r.Count), c.lookup)
+	if err != nil {
+		return fmt.Errorf("failed to calculate count for reservation: %s", err)
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid count for reservation: %d", count)
+	}
+
+	if c.alignData {
+		c.align(r.Size/8, true)
+	}
+
+	if r.Name != "" {
+		c.define(r.Name)
+	}
+
+	// Storage reserved outside the bss is zero-filled.
+	n := int(count) * r.Size / 8
+	if c.section == nil {
+		c.code = append(c.code, make([]byte, n)...)
+	} else {
+		c.section.reserve(n)
+	}
+	return nil
+}
+
+// handleData appends the data to the current section of our binary,
 // and stores the offset appropriately
-func (c *Compiler) handleData(d parser.Data) {
+func (c *Compiler) handleData(d parser.Data) error {
 
-	// Offset of the start of the data is the current
-	// length of the existing data.
-	offset := len(c.data)
+	if c.section != nil && c.section.kind == "bss" {
+		return fmt.Errorf("data cannot be placed in the %s section, use RESB, etc, instead", c.section.name)
+	}
 
-	// Add
-	c.data = append(c.data, d.Contents...)
+	// Values are aligned to their size, which for DT is rounded
+	// up to sixteen bytes.
+	if c.alignData && d.Size > 8 {
+		size := d.Size / 8
+		if size == 10 {
+			size = 16
+		}
+		c.align(size, true)
+	}
 
-	// Save
-	c.dataOffsets[d.Name] = offset
+	// Save, unless the data is anonymous.
+	if d.Name != "" {
+		c.define(d.Name)
+	}
+
+	// Offset of the start of the data is the current
+	// length of the existing section.
+	offset := len(c.code)
+	if c.section != nil {
+		offset = len(c.section.contents)
+	}
 
-	// TODO: Do we care about alignment?  We might
-	// in the future.
+	// Values which must be calculated later, note that `$` refers
+	// to the start of the data.
+	for _, ref := range d.References {
+		c.fixups = append(c.fixups, fixup{
+			offset:   offset + ref.Offset,
+			section:  c.section,
+			value:    c.locate(ref.Value),
+			bits:     ref.Size,
+			location: c.p.Location(),
+		})
+	}
+
+	// Add
+	if c.section == nil {
+		c.code = append(c.code, d.Contents...)
+	} else {
+		c.section.contents = append(c.section.contents, d.Contents...)
+	}
+	return nil
 }
 
 // compileInstruction handles the instruction generation
 func (c *Compiler) compileInstruction(i parser.Instruction) error {
 
+	// Resolve references to the current location
+	for n, op := range i.Operands {
+		if op.Symbol == "$" || op.Symbol == "$$" {
+			op.Expression = expr.Binary{
+				Operator: "+",
+				Left:     expr.Symbol{Name: op.Symbol},
+				Right:    expr.Number{Value: op.Displacement},
+			}
+			op.Symbol = ""
+			op.Displacement = 0
+		}
+		if op.Expression != nil {
+			op.Expression = c.locate(op.Expression)
+		}
+		i.Operands[n] = op
+	}
+
 	switch i.Instruction {
 
+	case "adc":
+		err := c.assembleADC(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
 	case "add":
 		err := c.assembleADD(i)
 		if err != nil {
@@ -234,6 +900,13 @@ func (c *Compiler) compileInstruction(i parser.Instruction) error {
 		}
 		return nil
 
+	case "and":
+		err := c.assembleAND(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
 	case "call":
 		err := c.assembleCALL(i)
 		if err != nil {
@@ -271,6 +944,13 @@ func (c *Compiler) compileInstruction(i parser.Instruction) error {
 		}
 		return nil
 
+	case "enter":
+		err := c.assembleENTER(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
 	case "inc":
 		err := c.assembleINC(i)
 		if err != nil {
@@ -279,23 +959,37 @@ func (c *Compiler) compileInstruction(i parser.Instruction) error {
 		return nil
 
 	case "int":
-		n, err := c.argToByte(i.Operands[0].Token)
+		if !c.isImmediate(i.Operands[0]) {
+			return fmt.Errorf("INT requires a number: %v", i)
+		}
+		c.code = append(c.code, 0xcd)
+		err := c.emitImmediate(i.Operands[0], 8, false)
 		if err != nil {
 			return err
 		}
-		c.code = append(c.code, 0xcd)
-		c.code = append(c.code, n)
 		return nil
 
-	case "jmp", "jne", "je", "jz", "jnz":
+	case "jmp", "jne", "je", "jz", "jnz",
+		"loop", "loope", "loopz", "loopne", "loopnz", "jrcxz", "jecxz":
 		err := c.assembleJMP(i)
 		if err != nil {
 			return err
 		}
 		return nil
 
+	case "leave":
+		c.code = append(c.code, 0xc9)
+		return nil
+
 	case "mov":
-		err := c.assembleMov(i, false)
+		err := c.assembleMov(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "movabs":
+		err := c.assembleMovabs(i)
 		if err != nil {
 			return err
 		}
@@ -305,6 +999,13 @@ func (c *Compiler) compileInstruction(i parser.Instruction) error {
 		c.code = append(c.code, 0x90)
 		return nil
 
+	case "or":
+		err := c.assembleOR(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
 	case "pop":
 		err := c.assemblePop(i)
 		if err != nil {
@@ -320,7 +1021,17 @@ func (c *Compiler) compileInstruction(i parser.Instruction) error {
 		return nil
 
 	case "ret":
-		c.code = append(c.code, 0xc3)
+		err := c.assembleRET(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
+	case "sbb":
+		err := c.assembleSBB(i)
+		if err != nil {
+			return err
+		}
 		return nil
 
 	case "stc":
@@ -341,6 +1052,18 @@ func (c *Compiler) compileInstruction(i parser.Instruction) error {
 			return err
 		}
 		return nil
+
+	case "syscall":
+		c.code = append(c.code, 0x0f, 0x05)
+		return nil
+
+	case "test":
+		err := c.assembleTEST(i)
+		if err != nil {
+			return err
+		}
+		return nil
+
 	case "xor":
 		err := c.assembleXOR(i)
 		if err != nil {
@@ -352,344 +1075,912 @@ func (c *Compiler) compileInstruction(i parser.Instruction) error {
 	return fmt.Errorf("unknown instruction %v", i)
 }
 
-// return register number - used for `dec`, `inc`, and `mov`.
-func (c *Compiler) getreg(reg string) int {
+// register describes one of the registers we know about.
+type register struct {
 
-	// registers
-	registers := []string{
-		"rax",
-		"rcx",
-		"rdx",
-		"rbx",
-		"rsp",
-		"rbp",
-		"rsi",
-		"rdi"}
+	// number is the encoding of the register.  Registers with a
+	// number greater than seven require a REX prefix to be used.
+	number int
 
-	for i, name := range registers {
-		if reg == name {
-			return i
-		}
+	// size is the size of the register, in bits.
+	size int
+
+	// rex is true for the byte-registers which can only be accessed
+	// via a REX prefix (spl, bpl, sil, dil).
+	rex bool
+
+	// high is true for the byte-registers which cannot be accessed
+	// if a REX prefix is present (ah, ch, dh, bh).
+	high bool
+}
+
+// registers holds the details of each of the registers we know about.
+var registers = map[string]register{
+	"rax": {number: 0, size: 64},
+	"rcx": {number: 1, size: 64},
+	"rdx": {number: 2, size: 64},
+	"rbx": {number: 3, size: 64},
+	"rsp": {number: 4, size: 64},
+	"rbp": {number: 5, size: 64},
+	"rsi": {number: 6, size: 64},
+	"rdi": {number: 7, size: 64},
+	"r8":  {number: 8, size: 64},
+	"r9":  {number: 9, size: 64},
+	"r10": {number: 10, size: 64},
+	"r11": {number: 11, size: 64},
+	"r12": {number: 12, size: 64},
+	"r13": {number: 13, size: 64},
+	"r14": {number: 14, size: 64},
+	"r15": {number: 15, size: 64},
+
+	"eax":  {number: 0, size: 32},
+	"ecx":  {number: 1, size: 32},
+	"edx":  {number: 2, size: 32},
+	"ebx":  {number: 3, size: 32},
+	"esp":  {number: 4, size: 32},
+	"ebp":  {number: 5, size: 32},
+	"esi":  {number: 6, size: 32},
+	"edi":  {number: 7, size: 32},
+	"r8d":  {number: 8, size: 32},
+	"r9d":  {number: 9, size: 32},
+	"r10d": {number: 10, size: 32},
+	"r11d": {number: 11, size: 32},
+	"r12d": {number: 12, size: 32},
+	"r13d": {number: 13, size: 32},
+	"r14d": {number: 14, size: 32},
+	"r15d": {number: 15, size: 32},
+
+	"ax":   {number: 0, size: 16},
+	"cx":   {number: 1, size: 16},
+	"dx":   {number: 2, size: 16},
+	"bx":   {number: 3, size: 16},
+	"sp":   {number: 4, size: 16},
+	"bp":   {number: 5, size: 16},
+	"si":   {number: 6, size: 16},
+	"di":   {number: 7, size: 16},
+	"r8w":  {number: 8, size: 16},
+	"r9w":  {number: 9, size: 16},
+	"r10w": {number: 10, size: 16},
+	"r11w": {number: 11, size: 16},
+	"r12w": {number: 12, size: 16},
+	"r13w": {number: 13, size: 16},
+	"r14w": {number: 14, size: 16},
+	"r15w": {number: 15, size: 16},
+
+	"al":   {number: 0, size: 8},
+	"cl":   {number: 1, size: 8},
+	"dl":   {number: 2, size: 8},
+	"bl":   {number: 3, size: 8},
+	"spl":  {number: 4, size: 8, rex: true},
+	"bpl":  {number: 5, size: 8, rex: true},
+	"sil":  {number: 6, size: 8, rex: true},
+	"dil":  {number: 7, size: 8, rex: true},
+	"ah":   {number: 4, size: 8, high: true},
+	"ch":   {number: 5, size: 8, high: true},
+	"dh":   {number: 6, size: 8, high: true},
+	"bh":   {number: 7, size: 8, high: true},
+	"r8b":  {number: 8, size: 8},
+	"r9b":  {number: 9, size: 8},
+	"r10b": {number: 10, size: 8},
+	"r11b": {number: 11, size: 8},
+	"r12b": {number: 12, size: 8},
+	"r13b": {number: 13, size: 8},
+	"r14b": {number: 14, size: 8},
+	"r15b": {number: 15, size: 8},
+}
+
+// register returns the details of the named register.
+func (c *Compiler) register(name string) (register, error) {
+	reg, ok := registers[name]
+	if !ok {
+		return reg, fmt.Errorf("unknown register %s", name)
+	}
+	return reg, nil
+}
+
+// addressRegister returns the number of a register used to address
+// memory, which must be a 64-bit register.
+func (c *Compiler) addressRegister(name string) (int, error) {
+	reg, err := c.register(name)
+	if err != nil {
+		return 0, err
+	}
+	if reg.size != 64 {
+		return 0, fmt.Errorf("memory-operands must use 64-bit registers, not %s", name)
 	}
+	return reg.number, nil
+}
+
+// segmentPrefixes holds the override-prefix for each of the segment
+// registers.
+var segmentPrefixes = map[string]byte{
+	"es": 0x26,
+	"cs": 0x2e,
+	"ss": 0x36,
+	"ds": 0x3e,
+	"fs": 0x64,
+	"gs": 0x65,
+}
+
+// emitRM emits an instruction which uses a ModRM byte to describe its
+// operands.
+//
+// opcode contains the opcode-bytes, reg is the value to place in the
+// "reg" field of the ModRM byte (either a register-number or an opcode
+// extension), and rm is the operand described by the "r/m" field - which
+// is either a register, or a memory-reference.
+//
+// size is the operand-size, in bits, which is used to decide whether we
+// need an operand-size prefix, or a REX.W prefix.
+func (c *Compiler) emitRM(opcode []byte, reg int, rm parser.Operand, size int) error {
+	return c.encodeRM(opcode, register{number: reg}, rm, size)
+}
 
-	panic(fmt.Sprintf("failed to lookup register: %s", reg))
+// emitRegRM emits an instruction which uses a ModRM byte, where the
+// "reg" field holds the named register.
+func (c *Compiler) emitRegRM(opcode []byte, name string, rm parser.Operand, size int) error {
+	reg, err := c.register(name)
+	if err != nil {
+		return err
+	}
+	return c.encodeRM(opcode, reg, rm, size)
 }
 
-// get magic value for two-register operations (`add`, `sub`, `xor`).
-func (c *Compiler) calcRM(dest string, src string) byte {
+// encodeRM does the work for emitRM and emitRegRM.
+func (c *Compiler) encodeRM(opcode []byte, reg register, rm parser.Operand, size int) error {
+
+	// prefixes
+	prefix := []byte{}
+
+	// REX prefix, which we'll only emit if any bits are set, or if
+	// a byte-register requires it.
+	rex := byte(0x40)
+	if size == 64 {
+		rex |= 0x08
+	}
+	if reg.number > 7 {
+		rex |= 0x04
+	}
+	forceREX := reg.rex
+	noREX := reg.high
+
+	// segment-override
+	if rm.Segment != "" {
+		seg, ok := segmentPrefixes[rm.Segment]
+		if !ok {
+			return fmt.Errorf("unknown segment register %s", rm.Segment)
+		}
+		prefix = append(prefix, seg)
+	}
+
+	// operand-size override
+	if size == 16 {
+		prefix = append(prefix, 0x66)
+	}
+
+	// The ModRM byte, and anything which follows it.
+	tail := []byte{}
+	r := byte(reg.number&7) << 3
+
+	// If we reference a symbol this is the offset, within tail, of
+	// the displacement we'll need to patch.
+	patch := -1
+
+	switch {
+
+	// register
+	case !rm.Indirection:
+		n, err := c.register(rm.Literal)
+		if err != nil {
+			return err
+		}
+		if n.number > 7 {
+			rex |= 0x01
+		}
+		forceREX = forceREX || n.rex
+		noREX = noREX || n.high
+		tail = append(tail, 0xc0|r|byte(n.number&7))
+
+	// relative to the instruction-pointer
+	case rm.RIPRelative:
+		if rm.DisplacementSize == 8 {
+			return fmt.Errorf("{disp8} cannot be used with rip-relative memory-operands, which need a 32-bit displacement")
+		}
+		disp, err := c.disp32(rm)
+		if err != nil {
+			return err
+		}
+		tail = append(tail, 0x05|r)
+		patch = len(tail)
+		tail = append(tail, disp...)
+
+	// indirection
+	default:
+
+		// base-register, if any
+		base := -1
+		if rm.Type == token.REGISTER {
+			n, err := c.addressRegister(rm.Literal)
+			if err != nil {
+				return err
+			}
+			base = n
+			if n > 7 {
+				rex |= 0x01
+			}
+		}
+
+		// index-register, if any
+		index := -1
+		scale := byte(0)
+		if rm.Index != "" {
+			n, err := c.addressRegister(rm.Index)
+			if err != nil {
+				return err
+			}
+			if n == 4 {
+				return fmt.Errorf("rsp cannot be used as an index-register")
+			}
+			index = n
+			if n > 7 {
+				rex |= 0x02
+			}
+
+			switch rm.Scale {
+			case 1:
+				scale = 0x00
+			case 2:
+				scale = 0x40
+			case 4:
+				scale = 0x80
+			case 8:
+				scale = 0xc0
+			default:
+				return fmt.Errorf("invalid scale %d, must be 1, 2, 4, or 8", rm.Scale)
+			}
+		}
+
+		// Work out the addressing-mode, which depends upon the
+		// size of the displacement.
+		//
+		// Symbols always need a 32-bit displacement, and
+		// rbp & r13 always require a displacement.
+		small := rm.Displacement >= -128 && rm.Displacement <= 127
+		symbolic := rm.Symbol != "" || rm.Expression != nil
+
+		// An explicit size must never be overridden.
+		if rm.DisplacementSize == 8 && symbolic {
+			return fmt.Errorf("{disp8} cannot be used with a displacement which refers to a label, or data, which needs 32 bits")
+		}
+		if rm.DisplacementSize == 8 && base == -1 {
+			return fmt.Errorf("{disp8} cannot be used without a base-register, which needs a 32-bit displacement")
+		}
+
+		mod := byte(0x00)
+		switch {
+		case base == -1:
+			mod = 0x00
+		case symbolic || rm.DisplacementSize == 32:
+			mod = 0x80
+		case rm.DisplacementSize == 8:
+			if !small {
+				return fmt.Errorf("displacement %d does not fit in 8 bits", rm.Displacement)
+			}
+			mod = 0x40
+		case rm.Displacement == 0 && base&7 != 5:
+			mod = 0x00
+		case small:
+			mod = 0x40
+		default:
+			mod = 0x80
+		}
+
+		switch {
+
+		// No base-register means a SIB byte with no base,
+		// and a 32-bit displacement.
+		case base == -1:
+			idx := byte(4)
+			if index != -1 {
+				idx = byte(index & 7)
+			}
+			tail = append(tail, 0x04|r, scale|idx<<3|0x05)
+
+		// No index, and the base isn't rsp/r12 means no SIB.
+		case index == -1 && base&7 != 4:
+			tail = append(tail, mod|r|byte(base&7))
 
-	// registers
-	registers := []string{
-		"rax",
-		"rcx",
-		"rdx",
-		"rbx",
-		"rsp",
-		"rbp",
-		"rsi",
-		"rdi"}
+		// Otherwise we need a SIB
+		default:
+			idx := byte(4)
+			if index != -1 {
+				idx = byte(index & 7)
+			}
+			tail = append(tail, mod|0x04|r, scale|idx<<3|byte(base&7))
+		}
 
-	dN := -1
-	sN := -1
+		// Now the displacement
+		switch {
+		case mod == 0x00 && base == -1, mod == 0x80:
+			disp, err := c.disp32(rm)
+			if err != nil {
+				return err
+			}
+			patch = len(tail)
+			tail = append(tail, disp...)
+		case mod == 0x40:
+			tail = append(tail, byte(rm.Displacement))
+		}
+	}
 
-	for i, reg := range registers {
-		if reg == dest {
-			dN = i
+	if rex != 0x40 || forceREX {
+		if noREX {
+			return fmt.Errorf("ah, bh, ch, and dh cannot be used in an instruction which requires a REX prefix")
 		}
-		if reg == src {
-			sN = i
+		prefix = append(prefix, rex)
+	}
+
+	c.code = append(c.code, prefix...)
+	c.code = append(c.code, opcode...)
+
+	// Record the reference to the symbol, if we have one.
+	if patch >= 0 && (rm.Symbol != "" || rm.Expression != nil) {
 
+		value := rm.Expression
+		if value == nil {
+			value = expr.Binary{
+				Operator: "+",
+				Left:     expr.Symbol{Name: rm.Symbol},
+				Right:    expr.Number{Value: rm.Displacement},
+			}
 		}
+
+		c.fixups = append(c.fixups, fixup{
+			offset:   len(c.code) + patch,
+			value:    value,
+			bits:     32,
+			extended: true,
+			relative: rm.RIPRelative,
+			location: c.p.Location(),
+		})
+	}
+
+	c.code = append(c.code, tail...)
+	return nil
+}
+
+// disp32 returns the four-byte encoding of the displacement of the given
+// memory-operand, which is sign-extended so must fit in 32 bits.
+//
+// Displacements which refer to symbols are checked once they have been
+// calculated, so until then we use zeros.
+func (c *Compiler) disp32(rm parser.Operand) ([]byte, error) {
+
+	if rm.Symbol != "" || rm.Expression != nil {
+		return make([]byte, 4), nil
+	}
+
+	buf, err := c.immediate(rm.Displacement, 32, true)
+	if err != nil {
+		return nil, fmt.Errorf("displacement %d does not fit in 32 bits, when sign-extended", rm.Displacement)
+	}
+	return buf, nil
+}
+
+// isImmediate returns true if the given operand is a number, or an
+// expression which will evaluate to one.
+func (c *Compiler) isImmediate(op parser.Operand) bool {
+	return !op.Indirection && (op.Type == token.NUMBER || op.Expression != nil)
+}
+
+// label returns the name of the label the given operand refers to, if it
+// is a plain reference to one.
+func (c *Compiler) label(op parser.Operand) (string, bool) {
+	sym, ok := op.Expression.(expr.Symbol)
+	if !ok || op.Indirection {
+		return "", false
+	}
+	return sym.Name, true
+}
+
+// constant returns the value of an immediate operand, if it is known.
+//
+// Operands which refer to labels, or data, cannot be calculated until
+// the program has been laid out, in which case known will be false.
+func (c *Compiler) constant(op parser.Operand) (n int64, known bool, err error) {
+	if op.Expression != nil {
+		n, err = expr.Evaluate(op.Expression, c.constantValue)
+		return n, err == nil, nil
+	}
+	n, err = c.parseNumber(op.Token)
+	return n, err == nil, err
+}
+
+// emitImmediate appends the value of an immediate operand to our code,
+// using the given number of bits.
+//
+// If the value isn't yet known then we'll emit zeros, and record a fixup
+// to patch them once it is.
+func (c *Compiler) emitImmediate(op parser.Operand, bits int, extended bool) error {
+
+	n, known, err := c.constant(op)
+	if err != nil {
+		return err
 	}
 
-	if dN < 0 || sN < 0 {
-		panic(fmt.Sprintf("failed to lookup registers: %s %s", src, dest))
+	if !known {
+		c.fixups = append(c.fixups, fixup{
+			offset:   len(c.code),
+			value:    op.Expression,
+			bits:     bits,
+			extended: extended,
+			location: c.p.Location(),
+		})
+		c.code = append(c.code, make([]byte, bits/8)...)
+		return nil
 	}
 
-	out := 0xc0 + (8 * sN) + dN
-	if out > 255 {
-		panic("calcRM received out of bounds value")
+	buf, err := c.immediate(n, bits, extended)
+	if err != nil {
+		return err
 	}
-	return byte(out)
+	c.code = append(c.code, buf...)
+	return nil
 }
 
-// used by `int`
-func (c *Compiler) argToByte(t token.Token) (byte, error) {
+// parseNumber converts the literal of the given token to a number.
+func (c *Compiler) parseNumber(t token.Token) (int64, error) {
 
-	num, err := strconv.ParseInt(t.Literal, 0, 64)
+	num, err := token.ParseNumber(t.Literal)
 	if err != nil {
 		return 0, fmt.Errorf("unable to convert %s to number %s", t.Literal, err)
 	}
+	return num, nil
+}
+
+// immediate returns the little-endian encoding of the given number,
+// using the given number of bits.
+//
+// An error is returned if the number doesn't fit.  Numbers which will be
+// sign-extended to 64-bits by the processor must be valid signed values,
+// otherwise either a signed or an unsigned value is accepted.
+func (c *Compiler) immediate(n int64, bits int, extended bool) ([]byte, error) {
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(n))
+
+	if bits == 64 {
+		return buf, nil
+	}
+
+	min := int64(-1) << (bits - 1)
+	max := int64(1)<<bits - 1
+	if extended {
+		max = int64(1)<<(bits-1) - 1
+	}
+
+	if n < min || n > max {
+		if extended {
+			return nil, fmt.Errorf("immediate value %d does not fit in %d bits, when sign-extended", n, bits)
+		}
+		return nil, fmt.Errorf("immediate value %d does not fit in %d bits", n, bits)
+	}
+
+	return buf[:bits/8], nil
+}
+
+// signExtend returns the given number, treating its lowest bits as a
+// signed value of the given size.
+func signExtend(n int64, bits int) int64 {
+	shift := uint(64 - bits)
+	return n << shift >> shift
+}
+
+// immediateSize returns the number of bits used to encode an immediate
+// for an operand of the given size, along with whether it will be
+// sign-extended.
+//
+// Immediates are never larger than 32-bits, except for `movabs`.
+func (c *Compiler) immediateSize(size int) (int, bool) {
+	if size == 64 {
+		return 32, true
+	}
+	return size, false
+}
+
+// operandSize returns the size, in bits, of an operation upon the given
+// operands.
+//
+// The size is taken from any register operands, or from the size given
+// to any memory-operands, immediates have no size of their own.  An error
+// is returned if the sizes conflict, or if there is no size at all.
+func (c *Compiler) operandSize(i parser.Instruction) (int, error) {
+
+	size := 0
+	for _, op := range i.Operands {
+
+		n := 0
+		switch {
+		case op.Indirection:
+			n = op.Size
+		case op.Type == token.REGISTER:
+			reg, err := c.register(op.Literal)
+			if err != nil {
+				return 0, err
+			}
+			n = reg.size
+		}
+
+		if n == 0 {
+			continue
+		}
+		if size != 0 && n != size {
+			return 0, fmt.Errorf("operand-size mismatch: %v", i)
+		}
+		size = n
+	}
+
+	switch size {
+	case 8, 16, 32, 64:
+	case 0:
+		return 0, fmt.Errorf("operand-size must be specified for memory-operands: %v", i)
+	default:
+		return 0, fmt.Errorf("unknown size in instruction %v", i)
+	}
+	return size, nil
+}
+
+// arithmetic handles the two-operand arithmetic instructions, which all
+// share the same set of encodings, for example `add rax, rbx`,
+// `sub [rdi], rcx`, or `cmp al, byte ptr [rsi]`.
+//
+// ext identifies the operation, and is used both as the opcode-extension
+// for the immediate forms and to calculate the opcode of the others.
+func (c *Compiler) arithmetic(i parser.Instruction, ext int) error {
+
+	dst := i.Operands[0]
+	src := i.Operands[1]
+
+	// Immediates are handled separately
+	if c.isImmediate(src) {
+		return c.arithmeticImmediate(i, ext)
+	}
+
+	if dst.Type != token.REGISTER && !dst.Indirection {
+		return fmt.Errorf("invalid destination for %s: %v", i.Instruction, i)
+	}
+	if src.Type != token.REGISTER && !src.Indirection {
+		return fmt.Errorf("invalid source for %s: %v", i.Instruction, i)
+	}
+	if dst.Indirection && src.Indirection {
+		return fmt.Errorf("only one operand of %s may reference memory: %v", i.Instruction, i)
+	}
+
+	size, err := c.operandSize(i)
+	if err != nil {
+		return err
+	}
+
+	// Byte-sized operations have an opcode one lower
+	opcode := byte(8*ext + 1)
+	if size == 8 {
+		opcode--
+	}
+
+	// r/m OP reg
+	if src.Type == token.REGISTER && !src.Indirection {
+		return c.emitRegRM([]byte{opcode}, src.Literal, dst, size)
+	}
 
-	return byte(num), nil
+	// reg OP r/m
+	return c.emitRegRM([]byte{opcode + 2}, dst.Literal, src, size)
 }
 
-// used by `mov`
-func (c *Compiler) argToByteArray(t token.Token) ([]byte, error) {
+// arithmeticImmediate handles the two-operand arithmetic instructions
+// when their second operand is a number, for example `add rbx, 1`, or
+// `cmp byte ptr [rax], 0x20`.
+//
+// ext is the opcode-extension which identifies the operation, this also
+// determines the opcode of the short forms which operate upon rax.
+//
+// We use the shortest encoding available, unless the number was
+// given a strict size.
+func (c *Compiler) arithmeticImmediate(i parser.Instruction, ext int) error {
 
-	// Store the result here
-	buf := make([]byte, 4)
+	dst := i.Operands[0]
+	src := i.Operands[1]
 
-	num, err := strconv.ParseInt(t.Literal, 0, 64)
+	// The size of the operation
+	size, err := c.operandSize(i)
 	if err != nil {
-		return buf, fmt.Errorf("unable to convert %s to number for register %s", t.Literal, err)
+		return err
 	}
 
-	binary.LittleEndian.PutUint32(buf, uint32(num))
-	return buf, nil
-}
-
-// assembleADD handles addition.
-func (c *Compiler) assembleADD(i parser.Instruction) error {
-
-	// Two registers added?
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.REGISTER {
-		c.code = append(c.code, []byte{0x48, 0x01}...)
-		out := c.calcRM(i.Operands[0].Literal, i.Operands[1].Literal)
-		c.code = append(c.code, out)
-		return nil
+	n, known, err := c.constant(src)
+	if err != nil {
+		return err
 	}
 
-	// OK number added to a register?
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.NUMBER {
-
-		// Convert the integer to a four-byte/64-bit value
-		n, err := c.argToByteArray(i.Operands[1].Token)
+	// Is the destination the accumulator?
+	acc := false
+	if !dst.Indirection {
+		reg, err := c.register(dst.Literal)
 		if err != nil {
 			return err
 		}
+		acc = reg.number == 0
+	}
 
-		// Work out the register
-		switch i.Operands[0].Literal {
-		case "rax":
-			c.code = append(c.code, []byte{0x48, 0x05}...)
-		case "rbx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xc3}...)
-		case "rcx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xc1}...)
-		case "rdx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xc2}...)
+	// Can the number be sign-extended from a byte?  If we don't
+	// know the value yet we'll have to assume not.
+	//
+	// The processor only sign-extends to the size of the operand, so
+	// for a 32-bit destination 0xffffffff is the same as -1.
+	if known && size != 64 {
+		if _, err := c.immediate(n, size, false); err == nil {
+			n = signExtend(n, size)
+		}
+	}
+	small := known && n >= -128 && n <= 127
+
+	// The size of the immediate we'll use.
+	bits, extended := c.immediateSize(size)
+	if size == 8 {
+		bits = 8
+	} else if src.Strict {
+		switch src.Size {
+		case 8:
+			extended = true
+		case bits:
 		default:
-			return fmt.Errorf("add %s, number not implemented", i.Operands[0].Literal)
+			return fmt.Errorf("strict size of immediate doesn't match the operand-size: %v", i)
 		}
+		bits = src.Size
+	} else if small {
+		bits = 8
+		extended = true
+	}
 
-		// Now append the value
-		c.code = append(c.code, n...)
+	// The sign-extended byte form
+	if bits == 8 && size != 8 {
+		err = c.emitRM([]byte{0x83}, ext, dst, size)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return c.emitImmediate(src, 8, extended)
+		}
+		buf, err := c.immediate(n, 8, extended)
+		if err != nil {
+			return err
+		}
+		c.code = append(c.code, buf...)
 		return nil
 	}
 
-	return fmt.Errorf("unhandled ADD instruction %v", i)
+	// The byte-sized forms
+	opcode := byte(0x81)
+	short := byte(0x05 + 8*ext)
+	if size == 8 {
+		opcode = 0x80
+		short = 0x04 + byte(8*ext)
+	}
+
+	// The accumulator has a shorter encoding, with no ModRM byte.
+	if acc {
+		if size == 16 {
+			c.code = append(c.code, 0x66)
+		}
+		if size == 64 {
+			c.code = append(c.code, 0x48)
+		}
+		c.code = append(c.code, short)
+		return c.emitImmediate(src, bits, extended)
+	}
+
+	err = c.emitRM([]byte{opcode}, ext, dst, size)
+	if err != nil {
+		return err
+	}
+	return c.emitImmediate(src, bits, extended)
+}
+
+// assembleADC handles addition, with carry.
+func (c *Compiler) assembleADC(i parser.Instruction) error {
+	return c.arithmetic(i, 2)
+}
+
+// assembleADD handles addition.
+func (c *Compiler) assembleADD(i parser.Instruction) error {
+	return c.arithmetic(i, 0)
+}
+
+// assembleAND handles bitwise-and.
+func (c *Compiler) assembleAND(i parser.Instruction) error {
+	return c.arithmetic(i, 4)
 }
 
 // Handle a call instruction
 func (c *Compiler) assembleCALL(i parser.Instruction) error {
 
-	if i.Operands[0].Type != token.IDENTIFIER {
-		return fmt.Errorf("we only support CALL to labels at the moment")
+	// Calling via a register, or memory?
+	if i.Operands[0].Type == token.REGISTER || i.Operands[0].Indirection {
+		return c.assembleIndirect(i, 2)
+	}
+
+	name, ok := c.label(i.Operands[0])
+	if !ok {
+		return fmt.Errorf("we only support CALL to labels, registers, and memory at the moment")
 	}
 
 	// emit the call
 	c.code = append(c.code, 0xe8)
 
-	c.calls[len(c.code)] = i.Operands[0].Literal
+	c.calls[len(c.code)] = name
+	c.sources[len(c.code)] = c.p.Location()
 	c.code = append(c.code, []byte{0x00, 0x00, 0x00, 0x00}...)
 
 	return nil
 }
 
-// Handle a comparison
-func (c *Compiler) assembleCMP(i parser.Instruction) error {
+// assembleIndirect handles calls and jumps via a register, or memory,
+// for example `call rax`, or `jmp qword ptr [table + rax*8]`.
+//
+// ext is the opcode-extension, which differs for `call` and `jmp`.
+func (c *Compiler) assembleIndirect(i parser.Instruction, ext int) error {
 
-	// We're only handling indirection at the moment
-	if i.Operands[0].Type != token.REGISTER &&
-		i.Operands[0].Indirection != true &&
-		i.Operands[1].Type != token.NUMBER {
-		return fmt.Errorf("we only support CMP size ptr [reg],NUMBER at the moment")
+	size := i.Operands[0].Size
+	if !i.Operands[0].Indirection {
+		reg, err := c.register(i.Operands[0].Literal)
+		if err != nil {
+			return err
+		}
+		size = reg.size
 	}
-
-	// The number we're comparing
-	n, err := strconv.ParseInt(i.Operands[1].Literal, 0, 64)
-	if err != nil {
-		return err
+	if size != 0 && size != 64 {
+		return fmt.Errorf("indirect targets must be qwords: %v", i)
 	}
 
-	// Register number
-	r := byte(c.getreg(i.Operands[0].Literal))
-
-	// things we add
-	bytes := []byte{}
-
-	switch i.Operands[0].Size {
-
-	case 8:
-		bytes = []byte{0x80, 0x38 + r, byte(n)}
-	case 16:
-		bytes = []byte{0x66, 0x83, 0x38 + r}
-
-		buf := make([]byte, 2)
-		binary.LittleEndian.PutUint16(buf, uint16(n))
-		bytes = append(bytes, buf...)
-
-	case 32, 64:
-		bytes = []byte{0x83, 0x38 + r}
-
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(n))
-		bytes = append(bytes, buf...)
-
-	default:
-		return fmt.Errorf("unknown size in instruction %v", i.Operands[0])
-	}
+	// The target is always 64-bit, so no REX.W is required.
+	return c.emitRM([]byte{0xff}, ext, i.Operands[0], 32)
+}
 
-	c.code = append(c.code, bytes...)
-	return nil
+// Handle a comparison
+func (c *Compiler) assembleCMP(i parser.Instruction) error {
+	return c.arithmetic(i, 7)
 }
 
 // assembleDEC handles dec rax, rbx, etc.
 func (c *Compiler) assembleDEC(i parser.Instruction) error {
 
-	// Decrement the contents of a register
-	if i.Operands[0].Indirection == false {
-		// prefix
-		c.code = append(c.code, []byte{0x48, 0xff}...)
-
-		// register name
-		reg := 0xc0 + c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
-
-		return nil
+	if i.Operands[0].Type != token.REGISTER && !i.Operands[0].Indirection {
+		return fmt.Errorf("unknown argument for DEC %v", i)
 	}
 
-	// indirect: byte
-	if i.Operands[0].Size == 8 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0xfe}...)
-
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		reg += 0x08
-		c.code = append(c.code, byte(reg))
+	// The size comes from the register, or the memory-operand
+	size, err := c.operandSize(i)
+	if err != nil {
+		return err
+	}
 
-		return nil
+	// byte
+	if size == 8 {
+		return c.emitRM([]byte{0xfe}, 1, i.Operands[0], 8)
 	}
 
-	// indirect: word
-	if i.Operands[0].Size == 16 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0x66, 0xff}...)
+	// word, double-word, and quad-word
+	return c.emitRM([]byte{0xff}, 1, i.Operands[0], size)
+}
 
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		reg += 0x08
-		c.code = append(c.code, byte(reg))
+// assembleENTER handles `enter 32, 0`, which creates a stack-frame.
+func (c *Compiler) assembleENTER(i parser.Instruction) error {
 
-		return nil
+	if !c.isImmediate(i.Operands[0]) ||
+		!c.isImmediate(i.Operands[1]) {
+		return fmt.Errorf("ENTER requires two numbers: %v", i)
 	}
 
-	// indirect: double word
-	if i.Operands[0].Size == 32 || i.Operands[0].Size == 64 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0xff}...)
-
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		reg += 0x08
-		c.code = append(c.code, byte(reg))
+	// The size of the frame
+	size, known, err := c.constant(i.Operands[0])
+	if err != nil {
+		return err
+	}
+	if known && (size < 0 || size > 0xffff) {
+		return fmt.Errorf("ENTER frame-size %d out of range", size)
+	}
 
-		return nil
+	// The nesting level
+	level, known, err := c.constant(i.Operands[1])
+	if err != nil {
+		return err
+	}
+	if known && (level < 0 || level > 0xff) {
+		return fmt.Errorf("ENTER nesting-level %d out of range", level)
 	}
 
-	return fmt.Errorf("unknown argument for DEC %v", i)
+	c.code = append(c.code, 0xc8)
+	err = c.emitImmediate(i.Operands[0], 16, false)
+	if err != nil {
+		return err
+	}
+	return c.emitImmediate(i.Operands[1], 8, false)
 }
 
 // assembleINC handles inc rax, rbx, etc.
 func (c *Compiler) assembleINC(i parser.Instruction) error {
 
-	// Increment the contents of a register
-	if i.Operands[0].Indirection == false {
-		// prefix
-		c.code = append(c.code, []byte{0x48, 0xff}...)
-
-		// register name
-		reg := 0xc0 + c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
-
-		return nil
-	}
-
-	// indirect: byte
-	if i.Operands[0].Size == 8 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0xfe}...)
-
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
-
-		return nil
+	if i.Operands[0].Type != token.REGISTER && !i.Operands[0].Indirection {
+		return fmt.Errorf("unknown argument for INC %v", i)
 	}
 
-	// indirect: word
-	if i.Operands[0].Size == 16 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0x66, 0xff}...)
-
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
-
-		return nil
+	// The size comes from the register, or the memory-operand
+	size, err := c.operandSize(i)
+	if err != nil {
+		return err
 	}
 
-	// indirect: double word
-	if i.Operands[0].Size == 32 || i.Operands[0].Size == 64 {
-		// prefix
-		c.code = append(c.code, []byte{0x67, 0xff}...)
-
-		// register name
-		reg := c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
-
-		return nil
+	// byte
+	if size == 8 {
+		return c.emitRM([]byte{0xfe}, 0, i.Operands[0], 8)
 	}
 
-	return fmt.Errorf("unknown argument for INC %v", i)
+	// word, double-word, and quad-word
+	return c.emitRM([]byte{0xff}, 0, i.Operands[0], size)
 }
 
-// assembleJMP handles all the jump instructions
+// assembleJMP handles all the jump instructions, as well as the loop
+// instructions, all of which branch to a label via an 8-bit displacement.
 //
 // NOTE We have to fixup the offsets here.
 func (c *Compiler) assembleJMP(i parser.Instruction) error {
 
-	var byte byte
+	var bytes []byte
 
 	switch i.Instruction {
 	case "jmp":
-		byte = 0xeb
+		bytes = []byte{0xeb}
 	case "je", "jz":
-		byte = 0x74
+		bytes = []byte{0x74}
 	case "jne", "jnz":
-		byte = 0x75
+		bytes = []byte{0x75}
+	case "loop":
+		bytes = []byte{0xe2}
+	case "loope", "loopz":
+		bytes = []byte{0xe1}
+	case "loopne", "loopnz":
+		bytes = []byte{0xe0}
+	case "jrcxz":
+		bytes = []byte{0xe3}
+	case "jecxz":
+		bytes = []byte{0x67, 0xe3}
 	default:
 		return fmt.Errorf("unknown jmp type")
 	}
 
+	// Jumping via a register, or memory?
+	if i.Operands[0].Type == token.REGISTER || i.Operands[0].Indirection {
+		if i.Instruction != "jmp" {
+			return fmt.Errorf("%s only supports labels: %v", i.Instruction, i)
+		}
+		return c.assembleIndirect(i, 4)
+	}
+
 	// Ensure we're jumping to a label
-	if i.Operands[0].Type != token.IDENTIFIER {
-		return fmt.Errorf("we only support jumps to labels at the moment")
+	name, ok := c.label(i.Operands[0])
+	if !ok {
+		return fmt.Errorf("we only support jumps to labels, registers, and memory at the moment")
 	}
 
 	// emit the instruction and make a note of the fixup to make
-	c.code = append(c.code, byte)
-	c.jmps[len(c.code)] = i.Operands[0].Literal
+	c.code = append(c.code, bytes...)
+	c.jmps[len(c.code)] = name
+	c.sources[len(c.code)] = c.p.Location()
 	c.code = append(c.code, 0x00) // empty displacement
 
 	return nil
 }
 
-func (c *Compiler) assembleMov(i parser.Instruction, label bool) error {
+func (c *Compiler) assembleMov(i parser.Instruction) error {
 
 	//
 	// Are we moving a register to another register?
@@ -701,11 +1992,16 @@ func (c *Compiler) assembleMov(i parser.Instruction, label bool) error {
 		i.Operands[1].Type == token.REGISTER &&
 		i.Operands[1].Indirection == false {
 
-		c.code = append(c.code, []byte{0x48, 0x89}...)
-		out := c.calcRM(i.Operands[0].Literal, i.Operands[1].Literal)
-		c.code = append(c.code, out)
-		return nil
+		size, err := c.operandSize(i)
+		if err != nil {
+			return err
+		}
 
+		opcode := byte(0x89)
+		if size == 8 {
+			opcode = 0x88
+		}
+		return c.emitRegRM([]byte{opcode}, i.Operands[1].Literal, i.Operands[0], size)
 	}
 
 	//
@@ -713,115 +2009,203 @@ func (c *Compiler) assembleMov(i parser.Instruction, label bool) error {
 	//
 	if i.Operands[0].Type == token.REGISTER &&
 		i.Operands[0].Indirection == false &&
-		i.Operands[1].Type == token.NUMBER {
-
-		// prefix
-		c.code = append(c.code, []byte{0x48, 0xc7}...)
+		c.isImmediate(i.Operands[1]) {
 
-		// register name
-		reg := 0xc0 + c.getreg(i.Operands[0].Literal)
-		c.code = append(c.code, byte(reg))
+		// value, if we know it
+		num, known, err := c.constant(i.Operands[1])
+		if err != nil {
+			return err
+		}
 
-		// value
-		n, err := c.argToByteArray(i.Operands[1].Token)
+		reg, err := c.register(i.Operands[0].Literal)
 		if err != nil {
 			return err
 		}
 
-		// hack
-		if label {
-			c.patches[len(c.code)], _ = strconv.Atoi(i.Operands[1].Literal)
+		// Registers smaller than 64-bits always use the short form
+		if reg.size != 64 {
+			if i.Operands[1].Strict && i.Operands[1].Size != reg.size {
+				return fmt.Errorf("strict size of immediate doesn't match the operand-size: %v", i)
+			}
+			return c.assembleMovShort(reg, i.Operands[1], reg.size)
 		}
-		c.code = append(c.code, n...)
-		return nil
-	}
 
-	// mov $reg, $id
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[0].Indirection == false &&
-		i.Operands[1].Type == token.IDENTIFIER {
+		// The size of the immediate
+		bits := 0
+		if i.Operands[1].Strict {
+			bits = i.Operands[1].Size
+		}
 
-		//
-		// Lookup the identifier, and if we can find it
-		// then we will treat it as a constant
-		//
-		name := i.Operands[1].Literal
-		val, ok := c.dataOffsets[name]
-		if ok {
+		switch bits {
+		case 0:
+			// Values we don't know yet are addresses,
+			// which will fit in a sign-extended 32-bits.
+			if !known {
+				break
+			}
+
+			// A positive 32-bit value can be moved into
+			// the 32-bit register, which zero-extends it.
+			if num >= 0 && num <= 0xffffffff {
+				return c.assembleMovShort(reg, i.Operands[1], 32)
+			}
+
+			// Too large to be sign-extended from 32-bits?
+			// Then we'll use the 64-bit form.
+			if num < -0x80000000 || num > 0x7fffffff {
+				return c.assembleMovabs(i)
+			}
+		case 32:
+		case 64:
+			return c.assembleMovabs(i)
+		default:
+			return fmt.Errorf("strict size of immediate doesn't match the operand-size: %v", i)
+		}
 
-			i.Operands[1].Type = token.NUMBER
-			i.Operands[1].Literal = fmt.Sprintf("%d", val)
-			return c.assembleMov(i, true)
+		err = c.emitRM([]byte{0xc7}, 0, i.Operands[0], 64)
+		if err != nil {
+			return err
 		}
-		return fmt.Errorf("reference to unknown label/data: %v", i.Operands[1])
+
+		return c.emitImmediate(i.Operands[1], 32, true)
 	}
 
 	// Storing a value in an address
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[0].Indirection &&
-		i.Operands[1].Type == token.NUMBER {
+	if i.Operands[0].Indirection &&
+		c.isImmediate(i.Operands[1]) {
 
-		// The number we're setting
-		n, err := strconv.ParseInt(i.Operands[1].Literal, 0, 64)
+		size, err := c.operandSize(i)
 		if err != nil {
 			return err
 		}
 
-		// Register number
-		r := byte(c.getreg(i.Operands[0].Literal))
+		opcode := byte(0xc7)
+		if size == 8 {
+			opcode = 0xc6
+		}
 
-		// things we add
-		bytes := []byte{}
+		err = c.emitRM([]byte{opcode}, 0, i.Operands[0], size)
+		if err != nil {
+			return err
+		}
 
-		switch i.Operands[0].Size {
+		bits, extended := c.immediateSize(size)
+		return c.emitImmediate(i.Operands[1], bits, extended)
+	}
 
-		case 8:
-			bytes = []byte{0xc6, r, byte(n)}
-		case 16:
-			bytes = []byte{0x66, 0xc7, byte(r)}
+	// mov $reg, [address]
+	if i.Operands[0].Type == token.REGISTER &&
+		i.Operands[0].Indirection == false &&
+		i.Operands[1].Indirection {
 
-			buf := make([]byte, 2)
-			binary.LittleEndian.PutUint16(buf, uint16(n))
-			bytes = append(bytes, buf...)
+		size, err := c.operandSize(i)
+		if err != nil {
+			return err
+		}
 
-		case 32, 64:
-			bytes = []byte{0xc7, r}
+		opcode := byte(0x8b)
+		if size == 8 {
+			opcode = 0x8a
+		}
+		return c.emitRegRM([]byte{opcode}, i.Operands[0].Literal, i.Operands[1], size)
+	}
 
-			buf := make([]byte, 4)
-			binary.LittleEndian.PutUint32(buf, uint32(n))
-			bytes = append(bytes, buf...)
+	// mov [address], $reg
+	if i.Operands[0].Indirection &&
+		i.Operands[1].Type == token.REGISTER &&
+		i.Operands[1].Indirection == false {
 
-		default:
-			return fmt.Errorf("unknown size in instruction %v", i.Operands[0])
+		size, err := c.operandSize(i)
+		if err != nil {
+			return err
+		}
+
+		opcode := byte(0x89)
+		if size == 8 {
+			opcode = 0x88
 		}
+		return c.emitRegRM([]byte{opcode}, i.Operands[1].Literal, i.Operands[0], size)
+	}
 
-		c.code = append(c.code, bytes...)
+	return fmt.Errorf("unknown MOV instruction: %v", i)
 
-		return nil
+}
+
+// assembleMovShort moves a number into a register via the short forms
+// which have no ModRM byte (B0+r, and B8+r).
+//
+// This is also used to move a positive 32-bit number into a 64-bit
+// register, via the 32-bit register, as the processor will zero the
+// upper-half of the 64-bit register.
+func (c *Compiler) assembleMovShort(reg register, op parser.Operand, size int) error {
+
+	if size == 16 {
+		c.code = append(c.code, 0x66)
 	}
 
-	//
-	// HACK
-	//
-	// mov rax, [REG]
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[0].Literal == "rax" &&
-		i.Operands[1].Type == token.REGISTER &&
-		i.Operands[1].Indirection {
+	// REX.B for the extended registers, and a plain REX for the
+	// byte-registers which require it.
+	if reg.number > 7 {
+		c.code = append(c.code, 0x41)
+	} else if reg.rex {
+		c.code = append(c.code, 0x40)
+	}
 
-		// Register number
-		r := byte(c.getreg(i.Operands[0].Literal))
-		c.code = append(c.code, []byte{0x8a, r}...)
-		return nil
+	opcode := byte(0xb8)
+	if size == 8 {
+		opcode = 0xb0
 	}
+	c.code = append(c.code, opcode+byte(reg.number&7))
+	return c.emitImmediate(op, size, false)
+}
 
-	return fmt.Errorf("unknown MOV instruction: %v", i)
+// assembleMovabs handles moving a 64-bit number into a register, for
+// example `movabs rax, 0x1122334455667788`.
+//
+// This is used automatically by `mov` if the number is too large to
+// be encoded as a sign-extended 32-bit value.
+func (c *Compiler) assembleMovabs(i parser.Instruction) error {
+
+	if i.Operands[0].Type != token.REGISTER ||
+		i.Operands[0].Indirection ||
+		!c.isImmediate(i.Operands[1]) {
+		return fmt.Errorf("we only support MOVABS $reg, $number: %v", i)
+	}
+
+	reg, err := c.register(i.Operands[0].Literal)
+	if err != nil {
+		return err
+	}
+	if reg.size != 64 {
+		return fmt.Errorf("MOVABS requires a 64-bit register: %v", i)
+	}
+
+	// REX.W, along with REX.B for the extended registers
+	rex := byte(0x48)
+	if reg.number > 7 {
+		rex |= 0x01
+	}
+
+	c.code = append(c.code, rex, 0xb8+byte(reg.number&7))
+	return c.emitImmediate(i.Operands[1], 64, false)
+}
 
+// assembleOR handles bitwise-or.
+func (c *Compiler) assembleOR(i parser.Instruction) error {
+	return c.arithmetic(i, 1)
 }
 
 // assemblePop would compile "pop offset", and "push 0x1234"
 func (c *Compiler) assemblePop(i parser.Instruction) error {
 
+	// Popping into memory?
+	if i.Operands[0].Indirection {
+		if i.Operands[0].Size != 0 && i.Operands[0].Size != 64 {
+			return fmt.Errorf("we only support popping qwords from the stack: %v", i)
+		}
+		return c.emitRM([]byte{0x8f}, 0, i.Operands[0], 32)
+	}
+
 	// known pop-types
 	table := make(map[string][]byte)
 	table["rax"] = []byte{0x58}
@@ -858,26 +2242,43 @@ func (c *Compiler) assemblePop(i parser.Instruction) error {
 // assemblePush would compile "push offset", and "push 0x1234"
 func (c *Compiler) assemblePush(i parser.Instruction) error {
 
-	// Is this a number?  Just output it
-	if i.Operands[0].Type == token.NUMBER {
-		n, err := c.argToByteArray(i.Operands[1].Token)
-		if err != nil {
-			return err
+	// Pushing the contents of memory?
+	if i.Operands[0].Indirection {
+		if i.Operands[0].Size != 0 && i.Operands[0].Size != 64 {
+			return fmt.Errorf("we only support pushing qwords to the stack: %v", i)
 		}
-		c.code = append(c.code, 0x68)
-		c.code = append(c.code, n...)
-		return nil
+		return c.emitRM([]byte{0xff}, 6, i.Operands[0], 32)
 	}
 
-	// Is this a label?
-	if i.Operands[0].Type == token.IDENTIFIER {
+	// Is this a number, or a label?  Just output it
+	if c.isImmediate(i.Operands[0]) {
 
-		c.code = append(c.code, 0x68)
+		n, known, err := c.constant(i.Operands[0])
+		if err != nil {
+			return err
+		}
+
+		// Small numbers have a compact form, unless
+		// a size was forced.
+		small := known && n >= -128 && n <= 127
+		if i.Operands[0].Strict {
+			switch i.Operands[0].Size {
+			case 8:
+				small = true
+			case 32:
+				small = false
+			default:
+				return fmt.Errorf("we only support pushing bytes or dwords: %v", i)
+			}
+		}
 
-		c.labelTargets[len(c.code)] = i.Operands[0].Literal
+		if small {
+			c.code = append(c.code, 0x6a)
+			return c.emitImmediate(i.Operands[0], 8, true)
+		}
 
-		c.code = append(c.code, []byte{0x0, 0x0, 0x0, 0x0}...)
-		return nil
+		c.code = append(c.code, 0x68)
+		return c.emitImmediate(i.Operands[0], 32, true)
 	}
 
 	// is this a register?
@@ -912,61 +2313,123 @@ func (c *Compiler) assemblePush(i parser.Instruction) error {
 	return fmt.Errorf("unknown push-type: %v", i)
 }
 
+// assembleRET handles `ret`, and `ret 16`.
+//
+// The latter form removes the given number of bytes from the stack
+// after returning, which is used for callee-cleanup.
+func (c *Compiler) assembleRET(i parser.Instruction) error {
+
+	// Plain return
+	if len(i.Operands) == 0 {
+		c.code = append(c.code, 0xc3)
+		return nil
+	}
+
+	if !c.isImmediate(i.Operands[0]) {
+		return fmt.Errorf("RET requires a number: %v", i)
+	}
+
+	n, known, err := c.constant(i.Operands[0])
+	if err != nil {
+		return err
+	}
+	if known && (n < 0 || n > 0xffff) {
+		return fmt.Errorf("RET value %d out of range", n)
+	}
+
+	c.code = append(c.code, 0xc2)
+	return c.emitImmediate(i.Operands[0], 16, false)
+}
+
+// assembleSBB handles subtraction, with borrow.
+func (c *Compiler) assembleSBB(i parser.Instruction) error {
+	return c.arithmetic(i, 3)
+}
+
 // assembleSUB handles subtraction.
 func (c *Compiler) assembleSUB(i parser.Instruction) error {
+	return c.arithmetic(i, 5)
+}
 
-	// Two registers subtracted?
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.REGISTER {
-		c.code = append(c.code, []byte{0x48, 0x29}...)
-		out := c.calcRM(i.Operands[0].Literal, i.Operands[1].Literal)
-		c.code = append(c.code, out)
-		return nil
+// assembleTEST handles `test`, which performs a bitwise-and, updating
+// the flags but discarding the result.
+//
+// Unlike the other arithmetic instructions there is no sign-extended
+// byte form for immediates, and only the r/m operand can be memory,
+// though we allow the operands to be given in either order.
+func (c *Compiler) assembleTEST(i parser.Instruction) error {
+
+	dst := i.Operands[0]
+	src := i.Operands[1]
+
+	size, err := c.operandSize(i)
+	if err != nil {
+		return err
 	}
 
-	// OK number subtracted from a register?
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.NUMBER {
+	// Testing against a number?
+	if c.isImmediate(src) {
+
+		bits, extended := c.immediateSize(size)
+		if src.Strict && src.Size != bits {
+			return fmt.Errorf("strict size of immediate doesn't match the operand-size: %v", i)
+		}
+
+		// The accumulator has a shorter encoding
+		if dst.Type == token.REGISTER && !dst.Indirection {
+			reg, err := c.register(dst.Literal)
+			if err != nil {
+				return err
+			}
+			if reg.number == 0 {
+				switch size {
+				case 8:
+					c.code = append(c.code, 0xa8)
+				case 16:
+					c.code = append(c.code, 0x66, 0xa9)
+				case 32:
+					c.code = append(c.code, 0xa9)
+				case 64:
+					c.code = append(c.code, 0x48, 0xa9)
+				}
+				return c.emitImmediate(src, bits, extended)
+			}
+		}
 
-		// Convert the integer to a four-byte/64-bit value
-		n, err := c.argToByteArray(i.Operands[1].Token)
+		opcode := byte(0xf7)
+		if size == 8 {
+			opcode = 0xf6
+		}
+		err = c.emitRM([]byte{opcode}, 0, dst, size)
 		if err != nil {
 			return err
 		}
+		return c.emitImmediate(src, bits, extended)
+	}
 
-		// Work out the register
-		switch i.Operands[0].Literal {
-		case "rax":
-			c.code = append(c.code, []byte{0x48, 0x2d}...)
-		case "rbx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xeb}...)
-		case "rcx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xe9}...)
-		case "rdx":
-			c.code = append(c.code, []byte{0x48, 0x81, 0xea}...)
-		default:
-			return fmt.Errorf("SUB %s, number not implemented", i.Operands[0].Literal)
-		}
+	if dst.Type != token.REGISTER && !dst.Indirection {
+		return fmt.Errorf("invalid operand for TEST: %v", i)
+	}
+	if src.Type != token.REGISTER && !src.Indirection {
+		return fmt.Errorf("invalid operand for TEST: %v", i)
+	}
+	if dst.Indirection && src.Indirection {
+		return fmt.Errorf("only one operand of TEST may reference memory: %v", i)
+	}
 
-		// Now append the value
-		c.code = append(c.code, n...)
-		return nil
+	opcode := byte(0x85)
+	if size == 8 {
+		opcode = 0x84
 	}
 
-	return fmt.Errorf("unhandled SUB instruction %v", i)
+	// The register goes in the "reg" field, wherever it was written.
+	if src.Indirection {
+		return c.emitRegRM([]byte{opcode}, dst.Literal, src, size)
+	}
+	return c.emitRegRM([]byte{opcode}, src.Literal, dst, size)
 }
 
 // assembleXOR handles xor rax, rbx, etc.
 func (c *Compiler) assembleXOR(i parser.Instruction) error {
-
-	// Two registers xor'd?
-	if i.Operands[0].Type == token.REGISTER &&
-		i.Operands[1].Type == token.REGISTER {
-		c.code = append(c.code, []byte{0x48, 0x31}...)
-		out := c.calcRM(i.Operands[0].Literal, i.Operands[1].Literal)
-		c.code = append(c.code, out)
-		return nil
-	}
-
-	return fmt.Errorf("unknown argument for XOR %v", i)
+	return c.arithmetic(i, 6)
 }
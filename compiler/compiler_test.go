@@ -0,0 +1,491 @@
+package compiler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// assemble compiles the given program, and returns the contents of the
+// binary which follow the headers, starting with the code.
+func assemble(t *testing.T, src string) ([]byte, error) {
+
+	dir, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := New(src)
+	c.SetOutput(filepath.Join(dir, "a.out"))
+	err = c.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(dir, "a.out"))
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	return out[0x40+(2*0x38):], nil
+}
+
+// compare assembles each of the given programs, and tests that the
+// output begins with the expected bytes.
+func compare(t *testing.T, tests map[string][]byte) {
+
+	for src, expected := range tests {
+		out, err := assemble(t, src)
+		if err != nil {
+			t.Fatalf("unexpected error assembling %s: %s", src, err)
+		}
+		if !bytes.HasPrefix(out, expected) {
+			t.Fatalf("wrong output for %s, expected % x, got % x", src, expected, out)
+		}
+	}
+}
+
+// failures assembles each of the given programs, and tests that they
+// fail with an error containing the expected text.
+func failures(t *testing.T, tests map[string]string) {
+
+	for src, expected := range tests {
+		_, err := assemble(t, src)
+		if err == nil {
+			t.Fatalf("expected an error assembling %s", src)
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("wrong error for %s, expected '%s', got '%s'", src, expected, err)
+		}
+	}
+}
+
+// Test that displacements must fit in a sign-extended 32-bit value.
+func TestDisplacement(t *testing.T) {
+
+	tests := map[string][]byte{
+		"mov rax, [rbx+0x7fffffff]":       {0x48, 0x8b, 0x83, 0xff, 0xff, 0xff, 0x7f},
+		"mov rax, [rbx-0x80000000]":       {0x48, 0x8b, 0x83, 0x00, 0x00, 0x00, 0x80},
+		"mov rax, qword ptr [0x7fffffff]": {0x48, 0x8b, 0x04, 0x25, 0xff, 0xff, 0xff, 0x7f},
+	}
+
+	for src, expected := range tests {
+		out, err := assemble(t, src)
+		if err != nil {
+			t.Fatalf("unexpected error assembling %s: %s", src, err)
+		}
+		if !bytes.HasPrefix(out, expected) {
+			t.Fatalf("wrong output for %s, expected % x, got % x", src, expected, out)
+		}
+	}
+
+	errors := []string{
+		"mov rax, [rbx+0x80000000]",
+		"mov rax, [rbx-0x80000001]",
+		"mov rax, [rbx+0x100000008]",
+		"mov rax, qword ptr [0x100000000]",
+	}
+
+	for _, src := range errors {
+		_, err := assemble(t, src)
+		if err == nil || !strings.Contains(err.Error(), "does not fit in 32 bits") {
+			t.Fatalf("expected a displacement error for %s, got %v", src, err)
+		}
+	}
+}
+
+// Test that immediates are sign-extended at the size of the operand when
+// deciding whether the short form can be used.
+func TestArithmeticImmediate(t *testing.T) {
+
+	tests := map[string][]byte{
+		"add eax, 0xffffffff": {0x83, 0xc0, 0xff},
+		"add eax, -1":         {0x83, 0xc0, 0xff},
+		"add eax, 0x7f":       {0x83, 0xc0, 0x7f},
+		"add eax, 0x80":       {0x05, 0x80, 0x00, 0x00, 0x00},
+		"sub ebx, 0xffffff80": {0x83, 0xeb, 0x80},
+		"add ax, 0xffff":      {0x66, 0x83, 0xc0, 0xff},
+		"add rax, 0x7fffffff": {0x48, 0x05, 0xff, 0xff, 0xff, 0x7f},
+		"add al, 0xff":        {0x04, 0xff},
+	}
+
+	for src, expected := range tests {
+		out, err := assemble(t, src)
+		if err != nil {
+			t.Fatalf("unexpected error assembling %s: %s", src, err)
+		}
+		if !bytes.HasPrefix(out, expected) {
+			t.Fatalf("wrong output for %s, expected % x, got % x", src, expected, out)
+		}
+	}
+
+	// 64-bit immediates are sign-extended from 32-bits.
+	_, err := assemble(t, "add rax, 0xffffffff")
+	if err == nil {
+		t.Fatalf("expected an error for an out of range immediate")
+	}
+}
+
+// Test that calls and jumps must be to known labels.
+func TestUnknownLabel(t *testing.T) {
+
+	tests := map[string]string{
+		"call nosuch":                       "input:1: call to unknown label: nosuch",
+		".somedata DB 1\ncall somedata":     "input:2: call to unknown label: somedata",
+		"jmp nosuch":                        "input:1: jump to unknown label: nosuch",
+		".somedata DB 1\njmp somedata":      "input:2: jump to unknown label: somedata",
+		":there\nnop\ncall there\njmp here": "input:4: jump to unknown label: here",
+	}
+
+	for src, expected := range tests {
+		_, err := assemble(t, src)
+		if err == nil {
+			t.Fatalf("expected an error assembling %s", src)
+		}
+		if err.Error() != expected {
+			t.Fatalf("wrong error for %s, expected '%s', got '%s'", src, expected, err)
+		}
+	}
+
+	out, err := assemble(t, ":there\nnop\ncall there")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.HasPrefix(out, []byte{0x90, 0xe8, 0xfa, 0xff, 0xff, 0xff}) {
+		t.Fatalf("wrong output for call, got % x", out)
+	}
+}
+
+// Test that reservations in the bss aren't written to the binary.
+func TestReserve(t *testing.T) {
+
+	out, err := assemble(t, "mov rax, last\n.buf resb 0x10000000\n.last resq 1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The code is followed by nothing at all.
+	if len(out) != 7 {
+		t.Fatalf("unexpected output, got % x", out)
+	}
+
+	// The address of `last` is after the code, in the data
+	// segment, and after the buffer.
+	addr := []byte{0x48, 0xc7, 0xc0, 0xb7, 0x00, 0x60, 0x10}
+	if !bytes.Equal(out, addr) {
+		t.Fatalf("wrong output, expected % x, got % x", addr, out)
+	}
+}
+
+// Test that directives may be used as the names of labels.
+func TestDirectiveNames(t *testing.T) {
+
+	out, err := assemble(t, "entry entry\njmp entry\n:entry\nmov rax, times\n.times DB 1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.HasPrefix(out, []byte{0xeb, 0x00, 0x48, 0xc7, 0xc0}) {
+		t.Fatalf("wrong output, got % x", out)
+	}
+}
+
+// Test that errors report their location, even within included files.
+func TestErrorLocations(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	main := filepath.Join(dir, "main.asm")
+	lib := filepath.Join(dir, "lib.inc")
+	from := " (included from " + main + ":2)"
+
+	tests := []struct {
+		lib      string
+		main     string
+		expected string
+	}{
+		{"nop\njmp nowhere", "", lib + ":2" + from + ": jump to unknown label: nowhere"},
+		{"nop\nnop\nint 256", "", lib + ":3" + from + ": immediate value 256 does not fit in 8 bits"},
+		{"nop\nmov rax", "", "error compiling - parser returned error " + lib + ":2" + from + ": "},
+		{"nop\n.x DB 1\nmov rax, x + nowhere", "", lib + ":3" + from + ": reference to unknown label/data: nowhere"},
+		{"nop\nnop", "\njmp gone", main + ":3: jump to unknown label: gone"},
+	}
+
+	for _, test := range tests {
+
+		src := "nop\n%include \"lib.inc\"" + test.main
+		err = ioutil.WriteFile(lib, []byte(test.lib), 0644)
+		if err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+
+		c := New(src)
+		c.SetFilename(main)
+		c.SetOutput(filepath.Join(dir, "a.out"))
+		err = c.Compile()
+		if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Fatalf("expected error '%s', got %v", test.expected, err)
+		}
+	}
+}
+
+// Test the encoding of register, and memory, operands of each size.
+func TestOperands(t *testing.T) {
+
+	compare(t, map[string][]byte{
+		"mov [rax], rbx":    {0x48, 0x89, 0x18},
+		"mov [rax], ebx":    {0x89, 0x18},
+		"mov [rax], bx":     {0x66, 0x89, 0x18},
+		"mov [rax], bl":     {0x88, 0x18},
+		"add al, [rsi]":     {0x02, 0x06},
+		"add rax, [rsi]":    {0x48, 0x03, 0x06},
+		"mov r13, [r13]":    {0x4d, 0x8b, 0x6d, 0x00},
+		"mov rax, [rbp]":    {0x48, 0x8b, 0x45, 0x00},
+		"mov eax, [rsp]":    {0x8b, 0x04, 0x24},
+		"mov eax, [r12]":    {0x41, 0x8b, 0x04, 0x24},
+		"mov rax, [rbx*8]":  {0x48, 0x8b, 0x04, 0xdd, 0x00, 0x00, 0x00, 0x00},
+		"mov rax, [8*rbx]":  {0x48, 0x8b, 0x04, 0xdd, 0x00, 0x00, 0x00, 0x00},
+		"mov [rsp+8], spl":  {0x40, 0x88, 0x64, 0x24, 0x08},
+		"mov sil, [rdi]":    {0x40, 0x8a, 0x37},
+		"mov ah, bh":        {0x88, 0xfc},
+		"mov r8b, al":       {0x41, 0x88, 0xc0},
+		"mov rax, rbx":      {0x48, 0x89, 0xd8},
+		"mov ax, r9w":       {0x66, 0x44, 0x89, 0xc8},
+		"mov r15d, [rax+8]": {0x44, 0x8b, 0x78, 0x08},
+	})
+
+	failures(t, map[string]string{
+		"mov rax, ebx": "operand-size mismatch",
+		"add al, bx":   "operand-size mismatch",
+		"mov [rax], 5": "operand-size must be specified",
+		"add [rax], 5": "operand-size must be specified",
+		"mov ah, sil":  "cannot be used in an instruction which requires a REX prefix",
+		"mov ah, [r8]": "cannot be used in an instruction which requires a REX prefix",
+		"mov r8b, ah":  "cannot be used in an instruction which requires a REX prefix",
+	})
+}
+
+// Test the forms of the arithmetic, and logical, instructions, with
+// registers, memory, and immediates of each size.
+func TestArithmetic(t *testing.T) {
+
+	compare(t, map[string][]byte{
+		"adc al, 1":                  {0x14, 0x01},
+		"adc ax, 0x1234":             {0x66, 0x15, 0x34, 0x12},
+		"adc eax, 0x12345678":        {0x15, 0x78, 0x56, 0x34, 0x12},
+		"adc rax, 0x12345678":        {0x48, 0x15, 0x78, 0x56, 0x34, 0x12},
+		"adc bl, 1":                  {0x80, 0xd3, 0x01},
+		"adc bx, 0x100":              {0x66, 0x81, 0xd3, 0x00, 0x01},
+		"adc ebx, 0x1000":            {0x81, 0xd3, 0x00, 0x10, 0x00, 0x00},
+		"adc rbx, -1":                {0x48, 0x83, 0xd3, 0xff},
+		"adc byte ptr [rax], 1":      {0x80, 0x10, 0x01},
+		"adc word ptr [rax], 0x100":  {0x66, 0x81, 0x10, 0x00, 0x01},
+		"adc dword ptr [rax], 1":     {0x83, 0x10, 0x01},
+		"adc qword ptr [rax], 0x100": {0x48, 0x81, 0x10, 0x00, 0x01, 0x00, 0x00},
+		"adc bl, cl":                 {0x10, 0xcb},
+		"adc rbx, rcx":               {0x48, 0x11, 0xcb},
+		"adc [rax], ecx":             {0x11, 0x08},
+		"adc cx, [rax]":              {0x66, 0x13, 0x08},
+		"adc r8, [rax]":              {0x4c, 0x13, 0x00},
+
+		"sbb al, 1":                  {0x1c, 0x01},
+		"sbb ax, 0x1234":             {0x66, 0x1d, 0x34, 0x12},
+		"sbb eax, 0x12345678":        {0x1d, 0x78, 0x56, 0x34, 0x12},
+		"sbb rax, 0x12345678":        {0x48, 0x1d, 0x78, 0x56, 0x34, 0x12},
+		"sbb bl, 1":                  {0x80, 0xdb, 0x01},
+		"sbb bx, 0x100":              {0x66, 0x81, 0xdb, 0x00, 0x01},
+		"sbb ebx, 0x1000":            {0x81, 0xdb, 0x00, 0x10, 0x00, 0x00},
+		"sbb rbx, -1":                {0x48, 0x83, 0xdb, 0xff},
+		"sbb byte ptr [rax], 1":      {0x80, 0x18, 0x01},
+		"sbb word ptr [rax], 0x100":  {0x66, 0x81, 0x18, 0x00, 0x01},
+		"sbb dword ptr [rax], 1":     {0x83, 0x18, 0x01},
+		"sbb qword ptr [rax], 0x100": {0x48, 0x81, 0x18, 0x00, 0x01, 0x00, 0x00},
+		"sbb bl, cl":                 {0x18, 0xcb},
+		"sbb rbx, rcx":               {0x48, 0x19, 0xcb},
+		"sbb [rax], ecx":             {0x19, 0x08},
+		"sbb cx, [rax]":              {0x66, 0x1b, 0x08},
+		"sbb r8, [rax]":              {0x4c, 0x1b, 0x00},
+
+		"and al, 1":                  {0x24, 0x01},
+		"and ax, 0x1234":             {0x66, 0x25, 0x34, 0x12},
+		"and eax, 0x12345678":        {0x25, 0x78, 0x56, 0x34, 0x12},
+		"and rax, 0x12345678":        {0x48, 0x25, 0x78, 0x56, 0x34, 0x12},
+		"and bl, 1":                  {0x80, 0xe3, 0x01},
+		"and bx, 0x100":              {0x66, 0x81, 0xe3, 0x00, 0x01},
+		"and ebx, 0x1000":            {0x81, 0xe3, 0x00, 0x10, 0x00, 0x00},
+		"and rbx, -1":                {0x48, 0x83, 0xe3, 0xff},
+		"and byte ptr [rax], 1":      {0x80, 0x20, 0x01},
+		"and word ptr [rax], 0x100":  {0x66, 0x81, 0x20, 0x00, 0x01},
+		"and dword ptr [rax], 1":     {0x83, 0x20, 0x01},
+		"and qword ptr [rax], 0x100": {0x48, 0x81, 0x20, 0x00, 0x01, 0x00, 0x00},
+		"and bl, cl":                 {0x20, 0xcb},
+		"and rbx, rcx":               {0x48, 0x21, 0xcb},
+		"and [rax], ecx":             {0x21, 0x08},
+		"and cx, [rax]":              {0x66, 0x23, 0x08},
+		"and r8, [rax]":              {0x4c, 0x23, 0x00},
+
+		"or al, 1":                  {0x0c, 0x01},
+		"or ax, 0x1234":             {0x66, 0x0d, 0x34, 0x12},
+		"or eax, 0x12345678":        {0x0d, 0x78, 0x56, 0x34, 0x12},
+		"or rax, 0x12345678":        {0x48, 0x0d, 0x78, 0x56, 0x34, 0x12},
+		"or bl, 1":                  {0x80, 0xcb, 0x01},
+		"or bx, 0x100":              {0x66, 0x81, 0xcb, 0x00, 0x01},
+		"or ebx, 0x1000":            {0x81, 0xcb, 0x00, 0x10, 0x00, 0x00},
+		"or rbx, -1":                {0x48, 0x83, 0xcb, 0xff},
+		"or byte ptr [rax], 1":      {0x80, 0x08, 0x01},
+		"or word ptr [rax], 0x100":  {0x66, 0x81, 0x08, 0x00, 0x01},
+		"or dword ptr [rax], 1":     {0x83, 0x08, 0x01},
+		"or qword ptr [rax], 0x100": {0x48, 0x81, 0x08, 0x00, 0x01, 0x00, 0x00},
+		"or bl, cl":                 {0x08, 0xcb},
+		"or rbx, rcx":               {0x48, 0x09, 0xcb},
+		"or [rax], ecx":             {0x09, 0x08},
+		"or cx, [rax]":              {0x66, 0x0b, 0x08},
+		"or r8, [rax]":              {0x4c, 0x0b, 0x00},
+	})
+
+	failures(t, map[string]string{
+		"adc qword ptr [rax], qword ptr [rbx]": "only one operand of adc may reference memory",
+		"sbb [rax], [rbx]":                     "may reference memory",
+		"and dword ptr [rax], dword ptr [rbx]": "only one operand of and may reference memory",
+		"or byte ptr [rax], byte ptr [rbx]":    "only one operand of or may reference memory",
+		"adc al, 256":                          "does not fit in 8 bits",
+	})
+}
+
+// Test the forms of TEST, which has no sign-extended immediates, and
+// whose operands may be given either way around.
+func TestTest(t *testing.T) {
+
+	compare(t, map[string][]byte{
+		"test al, 1":                  {0xa8, 0x01},
+		"test ax, 0x1234":             {0x66, 0xa9, 0x34, 0x12},
+		"test eax, 0x12345678":        {0xa9, 0x78, 0x56, 0x34, 0x12},
+		"test rax, 0x12345678":        {0x48, 0xa9, 0x78, 0x56, 0x34, 0x12},
+		"test bl, 1":                  {0xf6, 0xc3, 0x01},
+		"test bx, 0x100":              {0x66, 0xf7, 0xc3, 0x00, 0x01},
+		"test ebx, 0x1000":            {0xf7, 0xc3, 0x00, 0x10, 0x00, 0x00},
+		"test rbx, -1":                {0x48, 0xf7, 0xc3, 0xff, 0xff, 0xff, 0xff},
+		"test byte ptr [rax], 1":      {0xf6, 0x00, 0x01},
+		"test word ptr [rax], 0x100":  {0x66, 0xf7, 0x00, 0x00, 0x01},
+		"test dword ptr [rax], 1":     {0xf7, 0x00, 0x01, 0x00, 0x00, 0x00},
+		"test qword ptr [rax], 0x100": {0x48, 0xf7, 0x00, 0x00, 0x01, 0x00, 0x00},
+		"test bl, cl":                 {0x84, 0xcb},
+		"test rbx, rcx":               {0x48, 0x85, 0xcb},
+		"test [rax], ecx":             {0x85, 0x08},
+		"test cx, [rax]":              {0x66, 0x85, 0x08},
+		"test r8, [rax]":              {0x4c, 0x85, 0x00},
+		"test ecx, [rax]":             {0x85, 0x08},
+		"test [rax], cx":              {0x66, 0x85, 0x08},
+		"test [rax], r8b":             {0x44, 0x84, 0x00},
+		"test r8b, [rax]":             {0x44, 0x84, 0x00},
+	})
+
+	failures(t, map[string]string{
+		"test qword ptr [rax], qword ptr [rbx]": "only one operand of TEST may reference memory",
+		"test 1, al":                            "invalid operand for TEST",
+	})
+}
+
+// Test that the shortest form of mov is chosen for each immediate, and
+// that immediates which don't fit are errors.
+func TestMovImmediate(t *testing.T) {
+
+	compare(t, map[string][]byte{
+		"mov rax, 0x1122334455667788": {0x48, 0xb8, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11},
+		"mov r9, 0x1122334455667788":  {0x49, 0xb9, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11},
+		"mov rax, 0xffffffff":         {0xb8, 0xff, 0xff, 0xff, 0xff},
+		"mov rax, 0x80000000":         {0xb8, 0x00, 0x00, 0x00, 0x80},
+		"mov rax, -1":                 {0x48, 0xc7, 0xc0, 0xff, 0xff, 0xff, 0xff},
+		"movabs rax, 1":               {0x48, 0xb8, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	})
+
+	failures(t, map[string]string{
+		"int 256":                         "immediate value 256 does not fit in 8 bits",
+		"mov al, 256":                     "immediate value 256 does not fit in 8 bits",
+		"mov al, -129":                    "immediate value -129 does not fit in 8 bits",
+		"mov eax, 0x100000000":            "immediate value 4294967296 does not fit in 32 bits",
+		"mov qword ptr [rax], 0x80000000": "immediate value 2147483648 does not fit in 32 bits, when sign-extended",
+	})
+}
+
+// Test the loop instructions, and the range of short jumps.
+func TestShortJumps(t *testing.T) {
+
+	compare(t, map[string][]byte{
+		":a\nloop a":                 {0xe2, 0xfe},
+		":a\nloope a":                {0xe1, 0xfe},
+		":a\nloopne a":               {0xe0, 0xfe},
+		":a\njrcxz a":                {0xe3, 0xfe},
+		":a\njecxz a":                {0x67, 0xe3, 0xfd},
+		"jecxz b\nnop\n:b\n":         {0x67, 0xe3, 0x01, 0x90},
+		"jmp b\nnop\n:b\n":           {0xeb, 0x01, 0x90},
+		"je b\nnop\n:b\n":            {0x74, 0x01, 0x90},
+		"jne b\nnop\n:b\n":           {0x75, 0x01, 0x90},
+		"jmp b\ntimes 127 nop\n:b\n": {0xeb, 0x7f, 0x90},
+	})
+
+	// Backwards jumps, which we find at the end of the code.
+	tests := map[string][]byte{
+		":b\ntimes 126 nop\njmp b":   {0xeb, 0x80},
+		":b\ntimes 126 nop\nloop b":  {0xe2, 0x80},
+		":b\ntimes 125 nop\njecxz b": {0x67, 0xe3, 0x80},
+	}
+	for src, expected := range tests {
+		out, err := assemble(t, src)
+		if err != nil {
+			t.Fatalf("unexpected error assembling %s: %s", src, err)
+		}
+		if !bytes.HasSuffix(out, expected) {
+			t.Fatalf("wrong output for %s, expected % x, got % x", src, expected, out)
+		}
+	}
+
+	failures(t, map[string]string{
+		"jmp b\ntimes 128 nop\n:b\n":  "jump to b is out of range, 128 bytes away",
+		":b\ntimes 127 nop\njmp b":    "jump to b is out of range, -129 bytes away",
+		"loop b\ntimes 128 nop\n:b\n": "jump to b is out of range, 128 bytes away",
+		":b\ntimes 126 nop\njecxz b":  "jump to b is out of range, -129 bytes away",
+	})
+}
+
+// Test that code, and data, may refer to data which is defined later.
+func TestLaterData(t *testing.T) {
+
+	// The data follows the seven bytes of code, in the data
+	// segment, which is at 0x600000 + 0xb0 + 7.
+	compare(t, map[string][]byte{
+		"mov rax, later\n.later DB 1":   {0x48, 0xc7, 0xc0, 0xb7, 0x00, 0x60, 0x00, 0x01},
+		"mov rax, [later]\n.later DB 1": {0x48, 0x8b, 0x04, 0x25, 0xb8, 0x00, 0x60, 0x00, 0x01},
+		".p DQ later\n.later DB 7\nmov rax, p": {
+			0x48, 0xc7, 0xc0, 0xb7, 0x00, 0x60, 0x00,
+			0xbf, 0x00, 0x60, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x07,
+		},
+	})
+}
+
+// Test that an explicit size of displacement is never overridden.
+func TestDisplacementSize(t *testing.T) {
+
+	compare(t, map[string][]byte{
+		"{disp8} mov rax, [rbx+8]":                   {0x48, 0x8b, 0x43, 0x08},
+		"{disp8} mov rax, [rbx+(2*3)]":               {0x48, 0x8b, 0x43, 0x06},
+		"{disp32} mov rax, [rbx+8]":                  {0x48, 0x8b, 0x83, 0x08, 0x00, 0x00, 0x00},
+		"{disp32} mov rax, [rbx+later]\n.later DB 1": {0x48, 0x8b, 0x83, 0xb7, 0x00, 0x60, 0x00},
+	})
+
+	failures(t, map[string]string{
+		"{disp8} mov rax, [rbx+later]\n.later DB 1":   "{disp8} cannot be used with a displacement which refers to a label, or data",
+		"{disp8} mov rax, [rbx+later-4]\n.later DB 1": "{disp8} cannot be used with a displacement which refers to a label, or data",
+		"{disp8} mov rax, [rel later]\n.later DB 1":   "{disp8} cannot be used with rip-relative memory-operands",
+		"{disp8} mov rax, [8]":                        "{disp8} cannot be used without a base-register",
+		"{disp8} mov rax, [rbx*8+8]":                  "{disp8} cannot be used without a base-register",
+		"{disp8} mov rax, [rbx+128]":                  "displacement 128 does not fit in 8 bits",
+	})
+}
@@ -9,6 +9,10 @@ const (
 	virtualStartAddress     uint64 = 0x400000
 	dataVirtualStartAddress uint64 = 0x600000
 	alignment               uint64 = 0x200000
+
+	// headerSize is the size of the ELF header, and our two
+	// program headers, which precede the code.
+	headerSize uint64 = 0x40 + (2 * 0x38)
 )
 
 type Builder struct {
@@ -26,15 +30,39 @@ func (b *Builder) WriteValue(size int, value uint64) {
 }
 
 type Elf struct {
+	// entry is the address at which execution begins, if this is
+	// zero then execution begins at the start of the code.
+	entry uint64
 }
 
 func New() *Elf {
 	return &Elf{}
 }
 
-func (e *Elf) WriteContent(path string, textSection, dataSection []byte) error {
+// SetEntry sets the address at which execution begins.
+func (e *Elf) SetEntry(address uint64) {
+	e.entry = address
+}
+
+// Addresses returns the virtual addresses at which the text, read-only
+// data, data, and bss will be loaded, given their sizes.
+//
+// The read-only data immediately follows the code, in the text segment,
+// and the bss immediately follows the data, in the data segment.
+func Addresses(textSize, rodataSize, dataSize int) (text, rodata, data, bss uint64) {
+	text = virtualStartAddress + headerSize
+	rodata = text + uint64(textSize)
+	data = dataVirtualStartAddress + rodata + uint64(rodataSize) - virtualStartAddress
+	bss = data + uint64(dataSize)
+	return text, rodata, data, bss
+}
+
+// WriteContent writes an executable containing the given code and data
+// to the specified path.  bssSize is the amount of zeroed memory which is
+// reserved, after the data, when the program is loaded.
+func (e *Elf) WriteContent(path string, textSection, rodataSection, dataSection []byte, bssSize int) error {
 
-	data := e.buildELF(textSection, dataSection)
+	data := e.buildELF(textSection, rodataSection, dataSection, bssSize)
 	if err := ioutil.WriteFile(path, data, 0755); err != nil {
 		return err
 	}
@@ -42,11 +70,13 @@ func (e *Elf) WriteContent(path string, textSection, dataSection []byte) error {
 	return nil
 }
 
-func (e *Elf) buildELF(textSection, dataSection []byte) []byte {
-	textSize := uint64(len(textSection))
-	// Size of ELF header + 2 * size program header?
-	textOffset := uint64(0x40 + (2 * 0x38))
+func (e *Elf) buildELF(textSection, rodataSection, dataSection []byte, bssSize int) []byte {
+	textAddress, _, dataAddress, _ := Addresses(len(textSection), len(rodataSection), len(dataSection))
 
+	// The text segment holds the headers, the code, and the read-only
+	// data, and the data segment follows it in the file.
+	textSize := headerSize + uint64(len(textSection)) + uint64(len(rodataSection))
+	dataSize := uint64(len(dataSection))
 	var o Builder
 
 	// Build ELF Header
@@ -66,46 +96,48 @@ func (e *Elf) buildELF(textSection, dataSection []byte) []byte {
 
 	// 64-bit virtual offsets always start at 0x400000?? https://stackoverflow.com/questions/38549972/why-elf-executables-have-a-fixed-load-address
 	// This seems to be a convention set in the x86_64 system-v abi: https://refspecs.linuxfoundation.org/elf/x86_64-SysV-psABI.pdf P26
-	o.WriteValue(8, virtualStartAddress+textOffset)
+	if e.entry != 0 {
+		o.WriteValue(8, e.entry)
+	} else {
+		o.WriteValue(8, textAddress)
+	}
 
 	o.WriteBytes(0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Offset from file to program header
 	o.WriteBytes(0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Start of section header table
 	o.WriteBytes(0x00, 0x00, 0x00, 0x00)                         // Flags
 	o.WriteBytes(0x40, 0x00)                                     // Size of this header
 	o.WriteBytes(0x38, 0x00)                                     // Size of a program header table entry - This should always be the same for 64-bit
-	o.WriteBytes(0x02, 0x00)                                     // Length of sections: data and text for now
+	o.WriteBytes(0x02, 0x00)                                     // Number of program headers: text and data
 	o.WriteBytes(0x00, 0x00)                                     // Size of section header, which we aren't using
 	o.WriteBytes(0x00, 0x00)                                     // Number of entries section header
 	o.WriteBytes(0x00, 0x00)                                     // Index of section header table entry
 
 	// Build Program Header
-	// Text Segment
+	// Text Segment, which contains the read-only data too.
 	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // PT_LOAD, loadable segment. Both data and text segment use this.
-	o.WriteBytes(0x07, 0x00, 0x00, 0x00) // Flags: 0x4 executable, 0x2 write, 0x1 read
-	o.WriteValue(8, 0)                   // textOffset)          // Offset from the beginning of the file. These values depend on how big the header and segment sizes are.
+	o.WriteBytes(0x05, 0x00, 0x00, 0x00) // Flags: 0x4 read, 0x1 executable
+	o.WriteValue(8, 0)                   // Offset from the beginning of the file, we load the headers too.
 	o.WriteValue(8, virtualStartAddress)
 	o.WriteValue(8, virtualStartAddress) // Physical address, irrelavnt on linux.
-	o.WriteValue(8, textSize)            // Number of bytes in file image of segment, must be larger than or equal to the size of payload in segment. Should be zero for bss data.
+	o.WriteValue(8, textSize)            // Number of bytes in file image of segment, must be larger than or equal to the size of payload in segment.
 	o.WriteValue(8, textSize)            // Number of bytes in memory image of segment, is not always same size as file image.
 	o.WriteValue(8, alignment)
 
-	dataSize := uint64(len(dataSection))
-	dataOffset := uint64(textOffset + textSize)
-	dataVirtualAddress := dataVirtualStartAddress + dataOffset
-
 	// Build Program Header
-	// Data Segment
-	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // PT_LOAD, loadable segment. Both data and text segment use this.
-	o.WriteBytes(0x07, 0x00, 0x00, 0x00) // Flags: 0x4 executable, 0x2 write, 0x1 read
-	o.WriteValue(8, dataOffset)          // Offset address.
-	o.WriteValue(8, dataVirtualAddress)  // Virtual address.
-	o.WriteValue(8, dataVirtualAddress)  // Physical address.
-	o.WriteValue(8, dataSize)            // Number of bytes in file image.
-	o.WriteValue(8, dataSize)            // Number of bytes in memory image.
+	// Data Segment, the bss follows the data in memory but isn't
+	// present in the file, so the memory size is larger.
+	o.WriteBytes(0x01, 0x00, 0x00, 0x00)      // PT_LOAD, loadable segment. Both data and text segment use this.
+	o.WriteBytes(0x06, 0x00, 0x00, 0x00)      // Flags: 0x4 read, 0x2 write
+	o.WriteValue(8, textSize)                 // Offset address.
+	o.WriteValue(8, dataAddress)              // Virtual address.
+	o.WriteValue(8, dataAddress)              // Physical address.
+	o.WriteValue(8, dataSize)                 // Number of bytes in file image.
+	o.WriteValue(8, dataSize+uint64(bssSize)) // Number of bytes in memory image.
 	o.WriteValue(8, alignment)
 
 	// Output the text segment
 	o.WriteBytes(textSection...)
+	o.WriteBytes(rodataSection...)
 	// Output the data segment
 	o.WriteBytes(dataSection...)
 	return o.o
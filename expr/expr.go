@@ -0,0 +1,258 @@
+// Package expr contains the expressions which may be used in place of
+// numbers, within operands and data.
+//
+// An expression may refer to labels, data, and constants, in which case
+// it cannot be evaluated until the program has been laid out.  To cater
+// for that we parse expressions into a tree, which may be evaluated at
+// any later point, via Evaluate.
+package expr
+
+import (
+	"fmt"
+
+	"github.com/skx/assembler/token"
+)
+
+// Expression is the interface which all of our expression-nodes
+// implement.
+type Expression interface {
+	// Output this as a readable string
+	String() string
+}
+
+// Number holds a literal number.
+type Number struct {
+	// Token is the token the number was read from.
+	Token token.Token
+
+	// Value holds the value of the number.
+	Value int64
+}
+
+// String outputs this Number as a string.
+func (n Number) String() string {
+	if n.Token.Literal != "" {
+		return n.Token.Literal
+	}
+	return fmt.Sprintf("%d", n.Value)
+}
+
+// Symbol holds a reference to a label, data, or constant, by name.
+type Symbol struct {
+	// Name is the name of the thing we refer to.
+	Name string
+}
+
+// String outputs this Symbol as a string.
+func (s Symbol) String() string {
+	return s.Name
+}
+
+// Register holds a reference to a register.
+//
+// Registers are only valid within memory-operands, where they are
+// removed by the parser before the expression is evaluated.
+type Register struct {
+	// Name is the name of the register.
+	Name string
+}
+
+// String outputs this Register as a string.
+func (r Register) String() string {
+	return r.Name
+}
+
+// Unary holds a unary operation, for example `-x`, or `~x`.
+type Unary struct {
+	// Operator holds the operation.
+	Operator string
+
+	// Right holds the operand.
+	Right Expression
+}
+
+// String outputs this Unary operation as a string.
+func (u Unary) String() string {
+	return fmt.Sprintf("%s%s", u.Operator, u.Right)
+}
+
+// Binary holds a binary operation, for example `x + y`.
+type Binary struct {
+	// Operator holds the operation.
+	Operator string
+
+	// Left and Right hold the operands.
+	Left  Expression
+	Right Expression
+}
+
+// String outputs this Binary operation as a string.
+func (b Binary) String() string {
+	return fmt.Sprintf("(%s %s %s)", b.Left, b.Operator, b.Right)
+}
+
+// Evaluate returns the value of the given expression.
+//
+// lookup is invoked to find the value of any symbols the expression
+// refers to, it may be nil if there are none.
+func Evaluate(e Expression, lookup func(name string) (int64, error)) (int64, error) {
+
+	switch e := e.(type) {
+
+	case Number:
+		return e.Value, nil
+
+	case Symbol:
+		if lookup == nil {
+			return 0, fmt.Errorf("reference to unknown symbol: %s", e.Name)
+		}
+		return lookup(e.Name)
+
+	case Register:
+		return 0, fmt.Errorf("register %s cannot be used in an expression", e.Name)
+
+	case Unary:
+		val, err := Evaluate(e.Right, lookup)
+		if err != nil {
+			return 0, err
+		}
+
+		switch e.Operator {
+		case "-":
+			return -val, nil
+		case "+":
+			return val, nil
+		case "~":
+			return ^val, nil
+		case "!":
+			return truth(val == 0), nil
+		}
+		return 0, fmt.Errorf("unknown unary operator %s", e.Operator)
+
+	case Binary:
+		left, err := Evaluate(e.Left, lookup)
+		if err != nil {
+			return 0, err
+		}
+		right, err := Evaluate(e.Right, lookup)
+		if err != nil {
+			return 0, err
+		}
+
+		switch e.Operator {
+		case "+":
+			return left + right, nil
+		case "-":
+			return left - right, nil
+		case "*":
+			return left * right, nil
+		case "/", "%":
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero in %s", e)
+			}
+			if e.Operator == "/" {
+				return left / right, nil
+			}
+			return left % right, nil
+		case "<<", ">>":
+			if right < 0 {
+				return 0, fmt.Errorf("negative shift in %s", e)
+			}
+			if e.Operator == "<<" {
+				return int64(uint64(left) << uint64(right)), nil
+			}
+			return int64(uint64(left) >> uint64(right)), nil
+		case "&":
+			return left & right, nil
+		case "|":
+			return left | right, nil
+		case "==":
+			return truth(left == right), nil
+		case "!=":
+			return truth(left != right), nil
+		case "<":
+			return truth(left < right), nil
+		case "<=":
+			return truth(left <= right), nil
+		case ">":
+			return truth(left > right), nil
+		case ">=":
+			return truth(left >= right), nil
+		case "&&":
+			return truth(left != 0 && right != 0), nil
+		case "||":
+			return truth(left != 0 || right != 0), nil
+		}
+		return 0, fmt.Errorf("unknown binary operator %s", e.Operator)
+	}
+
+	return 0, fmt.Errorf("unknown expression %v", e)
+}
+
+// truth converts the result of a comparison into a number, one for true
+// and zero for false.
+func truth(val bool) int64 {
+	if val {
+		return 1
+	}
+	return 0
+}
+
+// Symbols returns the names of all the symbols the given expression
+// refers to.
+func Symbols(e Expression) []string {
+
+	switch e := e.(type) {
+	case Symbol:
+		return []string{e.Name}
+	case Unary:
+		return Symbols(e.Right)
+	case Binary:
+		return append(Symbols(e.Left), Symbols(e.Right)...)
+	}
+	return nil
+}
+
+// Registers returns the names of all the registers the given expression
+// refers to.
+func Registers(e Expression) []string {
+
+	switch e := e.(type) {
+	case Register:
+		return []string{e.Name}
+	case Unary:
+		return Registers(e.Right)
+	case Binary:
+		return append(Registers(e.Left), Registers(e.Right)...)
+	}
+	return nil
+}
+
+// Constant returns the value of the given expression, if it doesn't
+// refer to any symbols, or registers.
+//
+// ok will be false if the value cannot be calculated yet.
+func Constant(e Expression) (val int64, ok bool, err error) {
+
+	if len(Symbols(e)) > 0 || len(Registers(e)) > 0 {
+		return 0, false, nil
+	}
+
+	val, err = Evaluate(e, nil)
+	return val, err == nil, err
+}
+
+// Replace returns a copy of the given expression, in which each symbol
+// has been replaced by the result of calling fn upon it.
+func Replace(e Expression, fn func(s Symbol) Expression) Expression {
+
+	switch e := e.(type) {
+	case Symbol:
+		return fn(e)
+	case Unary:
+		return Unary{Operator: e.Operator, Right: Replace(e.Right, fn)}
+	case Binary:
+		return Binary{Operator: e.Operator, Left: Replace(e.Left, fn), Right: Replace(e.Right, fn)}
+	}
+	return e
+}
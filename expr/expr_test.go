@@ -0,0 +1,199 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/skx/assembler/lexer"
+	"github.com/skx/assembler/token"
+)
+
+// tokenize converts the given input into a series of tokens.
+func tokenize(input string) []token.Token {
+
+	var toks []token.Token
+
+	l := lexer.New(input)
+	tok := l.NextToken()
+	for tok.Type != token.EOF {
+		toks = append(toks, tok)
+		tok = l.NextToken()
+	}
+	return toks
+}
+
+// Test that we evaluate expressions with the correct precedence.
+func TestEvaluate(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Result int64
+	}
+
+	tests := []TestCase{
+		{Input: "3", Result: 3},
+		{Input: "1 + 2 * 3", Result: 7},
+		{Input: "(1 + 2) * 3", Result: 9},
+		{Input: "10 - 4 - 3", Result: 3},
+		{Input: "17 / 5", Result: 3},
+		{Input: "17 % 5", Result: 2},
+		{Input: "1 << 4 + 1", Result: 32},
+		{Input: "256 >> 4", Result: 16},
+		{Input: "12 & 10", Result: 8},
+		{Input: "12 | 3 & 1", Result: 13},
+		{Input: "~0", Result: -1},
+		{Input: "-3 + 5", Result: 2},
+		{Input: "--3", Result: 3},
+		{Input: "0x10 * 2", Result: 32},
+		{Input: "len - 1", Result: 12},
+		{Input: "(end - start) / 8", Result: 4},
+		{Input: "len == 13", Result: 1},
+		{Input: "len != 13", Result: 0},
+		{Input: "1 < 2", Result: 1},
+		{Input: "2 <= 1", Result: 0},
+		{Input: "2 > 1 + 1", Result: 0},
+		{Input: "2 >= 1 | 1", Result: 1},
+		{Input: "1 < 2 && 3 < 2", Result: 0},
+		{Input: "1 < 2 || 3 < 2", Result: 1},
+		{Input: "1 || 0 && 0", Result: 1},
+		{Input: "!0", Result: 1},
+		{Input: "!5", Result: 0},
+	}
+
+	symbols := map[string]int64{
+		"len":   13,
+		"start": 0x1000,
+		"end":   0x1020,
+	}
+	lookup := func(name string) (int64, error) {
+		val, ok := symbols[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown symbol %s", name)
+		}
+		return val, nil
+	}
+
+	for _, test := range tests {
+
+		toks := tokenize(test.Input)
+
+		e, n, err := Parse(toks)
+		if err != nil {
+			t.Fatalf("error parsing %s: %s", test.Input, err)
+		}
+		if n != len(toks) {
+			t.Fatalf("expected to consume %d tokens for %s, got %d", len(toks), test.Input, n)
+		}
+
+		out, err := Evaluate(e, lookup)
+		if err != nil {
+			t.Fatalf("error evaluating %s: %s", test.Input, err)
+		}
+		if out != test.Result {
+			t.Fatalf("wrong result for %s, expected %d got %d", test.Input, test.Result, out)
+		}
+	}
+}
+
+// Test that expressions stop at the end of the line, or at a token
+// which cannot continue them.
+func TestEnd(t *testing.T) {
+
+	tests := map[string]int{
+		"1 + 2, 3":    3,
+		"4 * x\n- 1":  3,
+		"(1 + 2) rax": 5,
+	}
+
+	for input, count := range tests {
+		_, n, err := Parse(tokenize(input))
+		if err != nil {
+			t.Fatalf("error parsing %s: %s", input, err)
+		}
+		if n != count {
+			t.Fatalf("expected %s to consume %d tokens, got %d", input, count, n)
+		}
+	}
+}
+
+// Test that we find the symbols and registers used in an expression.
+func TestConstant(t *testing.T) {
+
+	e, _, err := Parse(tokenize("rbx + table + 8 * 2"))
+	if err != nil {
+		t.Fatalf("error parsing: %s", err)
+	}
+	if strings.Join(Registers(e), ",") != "rbx" {
+		t.Fatalf("wrong registers: %v", Registers(e))
+	}
+	if strings.Join(Symbols(e), ",") != "table" {
+		t.Fatalf("wrong symbols: %v", Symbols(e))
+	}
+	_, ok, err := Constant(e)
+	if ok || err != nil {
+		t.Fatalf("expected a non-constant expression")
+	}
+
+	e, _, err = Parse(tokenize("(3 + 4) * 2"))
+	if err != nil {
+		t.Fatalf("error parsing: %s", err)
+	}
+	val, ok, err := Constant(e)
+	if !ok || err != nil || val != 14 {
+		t.Fatalf("expected a constant expression, got %d %v %v", val, ok, err)
+	}
+}
+
+// Test that errors are reported.
+func TestErrors(t *testing.T) {
+
+	tests := []string{
+		"(1 + 2",
+		"1 +",
+		"1 + ,",
+		"1 / 0",
+		"1 % (2 - 2)",
+		"1 << -1",
+		"unknown",
+		"rax + 1",
+	}
+
+	for _, input := range tests {
+		e, _, err := Parse(tokenize(input))
+		if err == nil {
+			_, err = Evaluate(e, nil)
+		}
+		if err == nil {
+			t.Fatalf("expected an error for %s", input)
+		}
+	}
+
+	_, _, err := Parse(nil)
+	if err == nil {
+		t.Fatalf("expected an error parsing nothing")
+	}
+}
+
+// Test that symbols can be replaced.
+func TestReplace(t *testing.T) {
+
+	e, _, err := Parse(tokenize("$ - start + 1"))
+	if err != nil {
+		t.Fatalf("error parsing: %s", err)
+	}
+
+	out := Replace(e, func(s Symbol) Expression {
+		if s.Name == "$" {
+			return Number{Value: 10}
+		}
+		return s
+	})
+
+	if out.String() != "((10 - start) + 1)" {
+		t.Fatalf("wrong result after replacement: %s", out)
+	}
+	if e.String() != "(($ - start) + 1)" {
+		t.Fatalf("original expression was modified: %s", e)
+	}
+}
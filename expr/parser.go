@@ -0,0 +1,172 @@
+package expr
+
+import (
+	"fmt"
+
+	"github.com/skx/assembler/token"
+)
+
+// precedence holds the binary operators we understand, and their
+// precedence.  Higher numbers bind more tightly.
+var precedence = map[token.Type]int{
+	token.OR:        1,
+	token.AND:       2,
+	token.EQ:        3,
+	token.NOT_EQ:    3,
+	token.LT:        3,
+	token.LT_EQUALS: 3,
+	token.GT:        3,
+	token.GT_EQUALS: 3,
+	token.PIPE:      4,
+	token.AMPERSAND: 5,
+	token.LSHIFT:    6,
+	token.RSHIFT:    6,
+	token.PLUS:      7,
+	token.MINUS:     7,
+	token.ASTERISK:  8,
+	token.SLASH:     8,
+	token.PERCENT:   8,
+}
+
+// parser holds the state of an expression which is being parsed.
+type parser struct {
+	// tokens holds the tokens we're parsing.
+	tokens []token.Token
+
+	// position holds our current offset within the tokens.
+	position int
+
+	// line holds the line the expression started upon.
+	line int
+}
+
+// Parse reads an expression from the start of the given tokens, and
+// returns it along with the number of tokens which were consumed.
+//
+// The expression ends at the first token which cannot continue it, or
+// at the end of the line upon which it started.
+func Parse(tokens []token.Token) (Expression, int, error) {
+
+	if len(tokens) == 0 {
+		return nil, 0, fmt.Errorf("expected expression, got EOF")
+	}
+
+	p := &parser{tokens: tokens, line: tokens[0].Line}
+	e, err := p.binary(0)
+	return e, p.position, err
+}
+
+// Starts returns true if the given token may start an expression.
+func Starts(tok token.Token) bool {
+	switch tok.Type {
+	case token.NUMBER, token.IDENTIFIER, token.REGISTER,
+		token.LPAREN, token.MINUS, token.PLUS, token.TILDE, token.BANG:
+		return true
+	}
+	return token.IsDirective(tok.Type)
+}
+
+// peek returns the current token, if there is one upon the same line
+// as the start of the expression.
+func (p *parser) peek() (token.Token, bool) {
+	if p.position >= len(p.tokens) ||
+		p.tokens[p.position].Line != p.line {
+		return token.Token{}, false
+	}
+	return p.tokens[p.position], true
+}
+
+// binary handles binary operations, with at least the given precedence.
+func (p *parser) binary(min int) (Expression, error) {
+
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok, ok := p.peek()
+		if !ok {
+			return left, nil
+		}
+		prec, ok := precedence[tok.Type]
+		if !ok || prec < min {
+			return left, nil
+		}
+		p.position++
+
+		right, err := p.binary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = Binary{Operator: tok.Literal, Left: left, Right: right}
+	}
+}
+
+// unary handles the unary operators.
+func (p *parser) unary() (Expression, error) {
+
+	tok, ok := p.peek()
+	if ok && (tok.Type == token.MINUS ||
+		tok.Type == token.PLUS ||
+		tok.Type == token.TILDE ||
+		tok.Type == token.BANG) {
+		p.position++
+
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Unary{Operator: tok.Literal, Right: right}, nil
+	}
+
+	return p.primary()
+}
+
+// primary handles numbers, names, and parenthesised expressions.
+func (p *parser) primary() (Expression, error) {
+
+	tok, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.position++
+
+	switch tok.Type {
+
+	case token.NUMBER:
+		num, err := token.ParseNumber(tok.Literal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert '%s' to number:%s", tok.Literal, err)
+		}
+		return Number{Token: tok, Value: num}, nil
+
+	case token.IDENTIFIER:
+		return Symbol{Name: tok.Literal}, nil
+
+	case token.REGISTER:
+		return Register{Name: tok.Literal}, nil
+
+	case token.ILLEGAL:
+		return nil, fmt.Errorf("%s", tok.Literal)
+
+	case token.LPAREN:
+		e, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		tok, ok = p.peek()
+		if !ok || tok.Type != token.RPAREN {
+			return nil, fmt.Errorf("expected ')' in expression")
+		}
+		p.position++
+		return e, nil
+	}
+
+	// Directives are names too, when they're used within expressions.
+	if token.IsDirective(tok.Type) {
+		return Symbol{Name: tok.Literal}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %v in expression", tok)
+}
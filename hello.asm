@@ -5,21 +5,27 @@
         ;; For less duplication see the code in `call.asm`.
         ;;
 
+SYS_EXIT  equ 1
+SYS_WRITE equ 4
+%define STDOUT 1
+
 .hello   DB "Hello, world\n"
+hello_len equ $ - hello            ;; the length of the string above
 .goodbye DB "Goodbye, world\n"
+goodbye_len equ $ - goodbye
 
-        mov rdx, 13        ;; write this many characters
+        mov rdx, hello_len ;; write this many characters
         mov rcx, hello     ;; starting at the string
-        mov rbx, 1         ;; write to STDOUT
-        mov rax, 4         ;; sys_write
+        mov rbx, STDOUT    ;; write to STDOUT
+        mov rax, SYS_WRITE ;; sys_write
         int 0x80           ;; syscall
 
-        mov rdx, 15        ;; write this many characters
+        mov rdx, goodbye_len ;; write this many characters
         mov rcx, goodbye   ;; starting at the string
-        mov rax, 4         ;; sys_write
-        mov rbx, 1         ;; write to STDOUT
+        mov rax, SYS_WRITE ;; sys_write
+        mov rbx, STDOUT    ;; write to STDOUT
         int 0x80           ;; syscall
 
         xor rbx, rbx       ;; exit-code is 0
-        mov rax, 0x01      ;; sys_exit
+        mov rax, SYS_EXIT  ;; sys_exit
         int 0x80           ;; syscall
@@ -16,6 +16,16 @@ var (
 	// entry for that will be `0`.
 	InstructionLengths map[string]int
 
+	// MinimumLengths is a map that returns the minimum number of
+	// operands the given assembly-language operation will accept,
+	// for the small number of instructions which have optional
+	// operands.
+	//
+	// For example `ret` may be used as either `ret`, or `ret 16`,
+	// so the entry in InstructionLengths will be `1` and the entry
+	// here will be `0`.
+	MinimumLengths map[string]int
+
 	// Instructions is automatically generated from the InstructionLengths
 	// map, and contains the known instruction-types we can lex, parse, and
 	// compile.
@@ -27,19 +37,30 @@ func init() {
 	// Setup our instruction-lengths
 	InstructionLengths = make(map[string]int)
 
+	InstructionLengths["adc"] = 2
 	InstructionLengths["add"] = 2
+	InstructionLengths["and"] = 2
 	InstructionLengths["cmp"] = 2
 	InstructionLengths["dec"] = 1
 	InstructionLengths["inc"] = 1
 	InstructionLengths["int"] = 1
 	InstructionLengths["mov"] = 2
+	InstructionLengths["movabs"] = 2
 	InstructionLengths["nop"] = 0
-	InstructionLengths["pop"] = 1
-	InstructionLengths["push"] = 1
-	InstructionLengths["ret"] = 0
+	InstructionLengths["or"] = 2
+	InstructionLengths["sbb"] = 2
 	InstructionLengths["sub"] = 2
+	InstructionLengths["syscall"] = 0
+	InstructionLengths["test"] = 2
 	InstructionLengths["xor"] = 2
 
+	// stack-frame
+	InstructionLengths["enter"] = 2
+	InstructionLengths["leave"] = 0
+	InstructionLengths["pop"] = 1
+	InstructionLengths["push"] = 1
+	InstructionLengths["ret"] = 1
+
 	// call
 	InstructionLengths["call"] = 1
 
@@ -50,6 +71,15 @@ func init() {
 	InstructionLengths["jnz"] = 1
 	InstructionLengths["jz"] = 1
 
+	// loops, which are jumps based upon rcx
+	InstructionLengths["jecxz"] = 1
+	InstructionLengths["jrcxz"] = 1
+	InstructionLengths["loop"] = 1
+	InstructionLengths["loope"] = 1
+	InstructionLengths["loopne"] = 1
+	InstructionLengths["loopnz"] = 1
+	InstructionLengths["loopz"] = 1
+
 	// Processor control instructions
 	InstructionLengths["clc"] = 0
 	InstructionLengths["cld"] = 0
@@ -59,6 +89,11 @@ func init() {
 	InstructionLengths["std"] = 0
 	InstructionLengths["sti"] = 0
 
+	// Setup the instructions which have optional operands
+	MinimumLengths = make(map[string]int)
+
+	MinimumLengths["ret"] = 0
+
 	// Now record the known-instructions
 	for k := range InstructionLengths {
 		Instructions = append(Instructions, k)
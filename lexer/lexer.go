@@ -4,6 +4,8 @@ package lexer
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"unicode"
 
 	"github.com/skx/assembler/token"
@@ -20,6 +22,9 @@ type Lexer struct {
 	// The current character
 	ch rune
 
+	// The line we're upon
+	line int
+
 	// A rune slice of our input string
 	characters []rune
 }
@@ -28,13 +33,16 @@ type Lexer struct {
 func New(input string) *Lexer {
 
 	// Line counting starts at one.
-	l := &Lexer{characters: []rune(input)}
+	l := &Lexer{characters: []rune(input), line: 1}
 	l.readChar()
 	return l
 }
 
 // read forward one character.
 func (l *Lexer) readChar() {
+	if l.ch == rune('\n') {
+		l.line++
+	}
 	if l.readPosition >= len(l.characters) {
 		l.ch = rune(0)
 	} else {
@@ -57,6 +65,9 @@ func (l *Lexer) NextToken() token.Token {
 		return (l.NextToken())
 	}
 
+	// Record the line the token starts upon.
+	tok.Line = l.line
+
 	switch l.ch {
 
 	case rune(0):
@@ -64,12 +75,23 @@ func (l *Lexer) NextToken() token.Token {
 		tok.Type = token.EOF
 
 	case rune(':'):
+
+		// A colon which immediately follows another token is
+		// a separator, as seen in `fs:[0x28]`.  Otherwise it
+		// is the start of a label-definition.
+		if l.position > 0 && !isWhitespace(l.characters[l.position-1]) {
+			tok.Type = token.COLON
+			tok.Literal = ":"
+			break
+		}
+
 		label, err := l.readLabel()
 		if err != nil {
 			tok.Literal = err.Error()
 			tok.Type = token.ILLEGAL
 		} else {
-			tok = token.Token{Type: token.LABEL, Literal: label}
+			tok.Type = token.LABEL
+			tok.Literal = label
 		}
 
 	case rune('.'):
@@ -78,20 +100,159 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Literal = err.Error()
 			tok.Type = token.ILLEGAL
 		} else {
-			tok = token.Token{Type: token.DATA, Literal: label}
+			tok.Type = token.DATA
+			tok.Literal = label
 		}
 
 	case rune(','):
-		tok = token.Token{Type: token.COMMA, Literal: ","}
+		tok.Type = token.COMMA
+		tok.Literal = ","
+
+	case rune('+'):
+		tok.Type = token.PLUS
+		tok.Literal = "+"
+
+	case rune('-'):
+		tok.Type = token.MINUS
+		tok.Literal = "-"
+
+	case rune('*'):
+		tok.Type = token.ASTERISK
+		tok.Literal = "*"
+
+	case rune('/'):
+		tok.Type = token.SLASH
+		tok.Literal = "/"
+
+	case rune('%'):
+
+		// A directive, such as `%define`, or the modulus operator
+		if unicode.IsLetter(l.peekChar()) {
+			l.readChar()
+			tok.Type = token.DIRECTIVE
+			tok.Literal = "%" + l.readIdentifier()
+			return tok
+		}
+
+		// A macro-parameter, such as `%1`, or a macro-local
+		// name such as `%%loop`
+		if isDigit(l.peekChar()) {
+			l.readChar()
+			tok.Type = token.PARAMETER
+			tok.Literal = "%" + l.readIdentifier()
+			return tok
+		}
+		if l.peekChar() == rune('%') {
+			l.readChar()
+			l.readChar()
+			tok.Type = token.PARAMETER
+			tok.Literal = "%%" + l.readIdentifier()
+			return tok
+		}
+		tok.Type = token.PERCENT
+		tok.Literal = "%"
+
+	case rune('&'):
+		if l.peekChar() == rune('&') {
+			l.readChar()
+			tok.Type = token.AND
+			tok.Literal = "&&"
+		} else {
+			tok.Type = token.AMPERSAND
+			tok.Literal = "&"
+		}
+
+	case rune('|'):
+		if l.peekChar() == rune('|') {
+			l.readChar()
+			tok.Type = token.OR
+			tok.Literal = "||"
+		} else {
+			tok.Type = token.PIPE
+			tok.Literal = "|"
+		}
+
+	case rune('!'):
+		if l.peekChar() == rune('=') {
+			l.readChar()
+			tok.Type = token.NOT_EQ
+			tok.Literal = "!="
+		} else {
+			tok.Type = token.BANG
+			tok.Literal = "!"
+		}
+
+	case rune('='):
+		if l.peekChar() == rune('=') {
+			l.readChar()
+			tok.Type = token.EQ
+			tok.Literal = "=="
+		} else {
+			tok.Type = token.ILLEGAL
+			tok.Literal = "unexpected character '='"
+		}
+
+	case rune('~'):
+		tok.Type = token.TILDE
+		tok.Literal = "~"
+
+	case rune('('):
+		tok.Type = token.LPAREN
+		tok.Literal = "("
+
+	case rune(')'):
+		tok.Type = token.RPAREN
+		tok.Literal = ")"
+
+	case rune('<'):
+		switch l.peekChar() {
+		case rune('<'):
+			l.readChar()
+			tok.Type = token.LSHIFT
+			tok.Literal = "<<"
+		case rune('='):
+			l.readChar()
+			tok.Type = token.LT_EQUALS
+			tok.Literal = "<="
+		default:
+			tok.Type = token.LT
+			tok.Literal = "<"
+		}
+
+	case rune('>'):
+		switch l.peekChar() {
+		case rune('>'):
+			l.readChar()
+			tok.Type = token.RSHIFT
+			tok.Literal = ">>"
+		case rune('='):
+			l.readChar()
+			tok.Type = token.GT_EQUALS
+			tok.Literal = ">="
+		default:
+			tok.Type = token.GT
+			tok.Literal = ">"
+		}
 
 	case rune('['):
-		tok = token.Token{Type: token.LSQUARE, Literal: "["}
+		tok.Type = token.LSQUARE
+		tok.Literal = "["
 
 	case rune(']'):
 
 		l.readChar()
 		return (l.NextToken())
 
+	case rune('{'):
+		opt, err := l.readEncoding()
+		if err == nil {
+			tok.Literal = opt
+			tok.Type = token.ENCODING
+		} else {
+			tok.Literal = err.Error()
+			tok.Type = token.ILLEGAL
+		}
+
 	case rune('"'):
 		str, err := l.readString('"')
 		if err == nil {
@@ -102,11 +263,28 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Type = token.ILLEGAL
 		}
 
+	case rune('\''):
+
+		// A character constant, such as 'A' or '\n', is a number.
+		str, err := l.readString('\'')
+		switch {
+		case err != nil:
+			tok.Literal = err.Error()
+			tok.Type = token.ILLEGAL
+		case len(str) != 1:
+			tok.Literal = fmt.Sprintf("character constants must contain a single character, got '%s'", str)
+			tok.Type = token.ILLEGAL
+		default:
+			tok.Literal = strconv.Itoa(int(str[0]))
+			tok.Type = token.NUMBER
+		}
+
 	default:
 		// Number?
 		if isDigit(l.ch) {
-			tok := l.readDecimal()
-			return tok
+			num := l.readDecimal()
+			num.Line = tok.Line
+			return num
 		}
 
 		// Instruction/Register
@@ -116,9 +294,9 @@ func (l *Lexer) NextToken() token.Token {
 			return tok
 		}
 
-		// Not an instruction/register (+LABEL)
-		tok.Type = token.IDENTIFIER
-		return tok
+		// Not something we recognize
+		tok.Type = token.ILLEGAL
+		tok.Literal = fmt.Sprintf("unexpected character '%c'", l.ch)
 
 	}
 
@@ -129,11 +307,15 @@ func (l *Lexer) NextToken() token.Token {
 
 // readIdentifier is designed to read an identifier (name of variable,
 // function, etc).
+//
+// A "." followed by more of the identifier is included, so that local
+// labels may be referred to by their full name, such as
+// `print_string.loop`.
 func (l *Lexer) readIdentifier() string {
 
 	id := ""
 
-	for isIdentifier(l.ch) {
+	for isIdentifier(l.ch) || (l.ch == rune('.') && isIdentifier(l.peekChar())) {
 		id += string(l.ch)
 		l.readChar()
 	}
@@ -155,13 +337,42 @@ func (l *Lexer) skipComment() {
 	l.skipWhitespace()
 }
 
-// read a number.  We only care about numerical digits here, floats will
-// be handled elsewhere.
+// read a number.  We only care about the digits here, fractions, exponents,
+// and most suffixes, are handled by readDecimal.
+//
+// Numbers may have a prefix giving their base, such as `0xff`, `0b1010`,
+// or `0o17`, or be hexadecimal with a suffix, such as `0ffh`.  The digits
+// may be separated by underscores, as in `1_000_000`.
 func (l *Lexer) readNumber() string {
 
 	id := ""
+	digit := func(ch rune) bool { return isDigit(ch) || ch == rune('_') }
+
+	// A hexadecimal suffix, which follows the digits.  This takes
+	// priority over a prefix, so that `0bbh` is hexadecimal.
+	n := 1
+	for isHexDigit(l.peekCharAt(n)) || l.peekCharAt(n) == rune('_') {
+		n++
+	}
+	next := l.peekCharAt(n)
+	if (next == rune('h') || next == rune('H')) && !isIdentifier(l.peekCharAt(n+1)) {
+		for n >= 0 {
+			id += string(l.ch)
+			l.readChar()
+			n--
+		}
+		return id
+	}
+
+	// A prefix
+	if l.ch == rune('0') && strings.ContainsRune("xXbBoO", l.peekChar()) && isHexDigit(l.peekCharAt(2)) {
+		id = "0" + string(l.peekChar())
+		l.readChar()
+		l.readChar()
+		digit = func(ch rune) bool { return isHexDigit(ch) || ch == rune('_') }
+	}
 
-	for isDigit(l.ch) || l.ch == rune('x') {
+	for digit(l.ch) {
 		id += string(l.ch)
 		l.readChar()
 	}
@@ -169,6 +380,10 @@ func (l *Lexer) readNumber() string {
 }
 
 // read a decimal number, either int or floating-point.
+//
+// Floating-point numbers have a fraction, an exponent, or both, such as
+// `1.5`, `3e8`, or `6.02e23`.  Hexadecimal floating-point numbers use `p`
+// to introduce their (binary) exponent, such as `0x1.8p3`.
 func (l *Lexer) readDecimal() token.Token {
 
 	//
@@ -176,6 +391,64 @@ func (l *Lexer) readDecimal() token.Token {
 	//
 	integer := l.readNumber()
 
+	hex := len(integer) > 1 && (integer[1] == 'x' || integer[1] == 'X')
+	digit := isDigit
+	exponent := "eE"
+	if hex {
+		digit = isHexDigit
+		exponent = "pP"
+	}
+
+	//
+	// A fraction?
+	//
+	float := false
+	if l.ch == rune('.') && digit(l.peekChar()) {
+		float = true
+		integer += string(l.ch)
+		l.readChar()
+		for digit(l.ch) {
+			integer += string(l.ch)
+			l.readChar()
+		}
+	}
+
+	//
+	// An exponent, which might be signed?
+	//
+	if strings.ContainsRune(exponent, l.ch) {
+		next := l.peekChar()
+		if next == rune('+') || next == rune('-') {
+			next = l.peekCharAt(2)
+		}
+		if isDigit(next) {
+			float = true
+			integer += string(l.ch)
+			l.readChar()
+			if l.ch == rune('+') || l.ch == rune('-') {
+				integer += string(l.ch)
+				l.readChar()
+			}
+			for isDigit(l.ch) {
+				integer += string(l.ch)
+				l.readChar()
+			}
+		}
+	}
+
+	if float {
+		return token.Token{Type: token.FLOAT, Literal: integer}
+	}
+
+	//
+	// A suffix, giving the base, such as `1010b` or `17o`, or a
+	// reference to an anonymous label, such as `1b` or `1f`.
+	//
+	if !hex && strings.ContainsRune("bBoOqQf", l.ch) && !isIdentifier(l.peekChar()) {
+		integer += string(l.ch)
+		l.readChar()
+	}
+
 	//
 	// Just an integer.
 	//
@@ -198,6 +471,10 @@ func (l *Lexer) readString(delim rune) (string, error) {
 		//
 		// Handle \n, \r, \t, \", etc.
 		//
+		// The character is decoded without changing l.ch, so
+		// that an escaped newline isn't counted as a new line.
+		//
+		ch := l.ch
 		if l.ch == '\\' {
 
 			// Line ending with "\" + newline
@@ -212,56 +489,85 @@ func (l *Lexer) readString(delim rune) (string, error) {
 			if l.ch == rune(0) {
 				return "", errors.New("unterminated string")
 			}
+			ch = l.ch
 			if l.ch == rune('n') {
-				l.ch = '\n'
+				ch = '\n'
 			}
 			if l.ch == rune('0') {
-				l.ch = rune(0)
+				ch = rune(0)
 			}
 			if l.ch == rune('r') {
-				l.ch = '\r'
+				ch = '\r'
 			}
 			if l.ch == rune('t') {
-				l.ch = '\t'
-			}
-			if l.ch == rune('"') {
-				l.ch = '"'
-			}
-			if l.ch == rune('\\') {
-				l.ch = '\\'
+				ch = '\t'
 			}
 		}
+		out = out + string(ch)
+	}
+
+	return out, nil
+}
+
+// read an encoding-option, such as `{disp32}`.
+func (l *Lexer) readEncoding() (string, error) {
+	out := ""
+
+	for {
+		l.readChar()
+
+		if l.ch == rune(0) || l.ch == rune('\n') {
+			return "", fmt.Errorf("unterminated encoding-option")
+		}
+		if l.ch == rune('}') {
+			break
+		}
 		out = out + string(l.ch)
 	}
 
 	return out, nil
 }
 
-// read a label
+// read a label, which continues until whitespace, or a comma, as seen in
+// `DQ .first, .second`.
+//
+// Names may not contain "-", as references to them would be read as a
+// subtraction.
 func (l *Lexer) readLabel() (string, error) {
 	out := ""
 
 	for {
+		if out != "" && l.peekChar() == rune(',') {
+			return label(out)
+		}
 		l.readChar()
 
 		if l.ch == rune(0) {
 			if len(out) > 1 {
-				return out, nil
+				return label(out)
 			}
 			return "", fmt.Errorf("unterminated label")
 		}
 		if isWhitespace(l.ch) {
-			return out, nil
+			return label(out)
 		}
 		out = out + string(l.ch)
 	}
 }
 
+// label checks that the name of a label, or data, may be referred to.
+func label(name string) (string, error) {
+	if strings.Contains(name, "-") {
+		return "", fmt.Errorf("names may not contain '-', as references to them would be a subtraction: %s", name)
+	}
+	return name, nil
+}
+
 // determinate ch is identifier or not.  Identifiers may be alphanumeric,
 // but they must start with a letter.  Here that works because we are only
 // called if the first character is alphabetical.
 func isIdentifier(ch rune) bool {
-	if unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '$' || ch == '_' || ch == '-' {
+	if unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '$' || ch == '_' {
 		return true
 	}
 	return false
@@ -277,10 +583,23 @@ func isDigit(ch rune) bool {
 	return rune('0') <= ch && ch <= rune('9')
 }
 
+// is hexadecimal Digit
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) ||
+		(rune('a') <= ch && ch <= rune('f')) ||
+		(rune('A') <= ch && ch <= rune('F'))
+}
+
 // peek character
 func (l *Lexer) peekChar() rune {
-	if l.readPosition >= len(l.characters) {
+	return l.peekCharAt(1)
+}
+
+// peek at the character the given distance ahead, without consuming
+// any input.
+func (l *Lexer) peekCharAt(n int) rune {
+	if l.readPosition+n-1 >= len(l.characters) {
 		return rune(0)
 	}
-	return l.characters[l.readPosition]
+	return l.characters[l.readPosition+n-1]
 }
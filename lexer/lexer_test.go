@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/skx/assembler/token"
@@ -159,10 +160,10 @@ func TestBrackets(t *testing.T) {
 		expectedLiteral string
 	}{
 		{token.INSTRUCTION, "mov"},
-		{token.IDENTIFIER, "eax"},
+		{token.REGISTER, "eax"},
 		{token.COMMA, ","},
 		{token.LSQUARE, "["},
-		{token.IDENTIFIER, "eax"},
+		{token.REGISTER, "eax"},
 		{token.EOF, ""},
 	}
 
@@ -178,3 +179,502 @@ func TestBrackets(t *testing.T) {
 	}
 
 }
+
+func TestSegment(t *testing.T) {
+
+	input := `mov rax, fs:[0x28]
+:label`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.SEGMENT, "fs"},
+		{token.COLON, ":"},
+		{token.LSQUARE, "["},
+		{token.NUMBER, "0x28"},
+		{token.LABEL, "label"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestDisplacement(t *testing.T) {
+
+	input := `push qword ptr [rbp+16]
+pop [rbx-8]`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+		expectedLine    int
+	}{
+		{token.INSTRUCTION, "push", 1},
+		{token.IDENTIFIER, "qword", 1},
+		{token.IDENTIFIER, "ptr", 1},
+		{token.LSQUARE, "[", 1},
+		{token.REGISTER, "rbp", 1},
+		{token.PLUS, "+", 1},
+		{token.NUMBER, "16", 1},
+		{token.INSTRUCTION, "pop", 2},
+		{token.LSQUARE, "[", 2},
+		{token.REGISTER, "rbx", 2},
+		{token.MINUS, "-", 2},
+		{token.NUMBER, "8", 2},
+		{token.EOF, "", 2},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - Line wrong, expected=%d, got=%d", i, tt.expectedLine, tok.Line)
+		}
+	}
+}
+
+func TestIllegal(t *testing.T) {
+
+	l := New("@")
+	tok := l.NextToken()
+	if tok.Type != token.ILLEGAL {
+		t.Fatalf("expected illegal token, got %v", tok)
+	}
+	tok = l.NextToken()
+	if tok.Type != token.EOF {
+		t.Fatalf("expected EOF, got %v", tok)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+
+	input := `{disp32} mov rax, [rbx]
+{disp8`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.ENCODING, "disp32"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.LSQUARE, "["},
+		{token.REGISTER, "rbx"},
+		{token.ILLEGAL, "unterminated encoding-option"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestOperators(t *testing.T) {
+
+	input := `mov rax, (1 << 4) | ~2 & 3 >> 1 / 2 % 5
+< > <= >= == != && || ! =`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.LPAREN, "("},
+		{token.NUMBER, "1"},
+		{token.LSHIFT, "<<"},
+		{token.NUMBER, "4"},
+		{token.RPAREN, ")"},
+		{token.PIPE, "|"},
+		{token.TILDE, "~"},
+		{token.NUMBER, "2"},
+		{token.AMPERSAND, "&"},
+		{token.NUMBER, "3"},
+		{token.RSHIFT, ">>"},
+		{token.NUMBER, "1"},
+		{token.SLASH, "/"},
+		{token.NUMBER, "2"},
+		{token.PERCENT, "%"},
+		{token.NUMBER, "5"},
+		{token.LT, "<"},
+		{token.GT, ">"},
+		{token.LT_EQUALS, "<="},
+		{token.GT_EQUALS, ">="},
+		{token.EQ, "=="},
+		{token.NOT_EQ, "!="},
+		{token.AND, "&&"},
+		{token.OR, "||"},
+		{token.BANG, "!"},
+		{token.ILLEGAL, "unexpected character '='"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestDirective(t *testing.T) {
+
+	input := `%define SIZE 8 % 3
+%undef`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.DIRECTIVE, "%define"},
+		{token.IDENTIFIER, "SIZE"},
+		{token.NUMBER, "8"},
+		{token.PERCENT, "%"},
+		{token.NUMBER, "3"},
+		{token.DIRECTIVE, "%undef"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestParameter(t *testing.T) {
+
+	input := `mov rcx, %1
+:%%loop jmp %%loop
+add rax, %10`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rcx"},
+		{token.COMMA, ","},
+		{token.PARAMETER, "%1"},
+		{token.LABEL, "%%loop"},
+		{token.INSTRUCTION, "jmp"},
+		{token.PARAMETER, "%%loop"},
+		{token.INSTRUCTION, "add"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.PARAMETER, "%10"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestFloat(t *testing.T) {
+
+	input := `DD 1.5, 3e8, 6.02e+23, 1e-3, 0x1.8p3, 0x1.cp-1
+mov rax, 3
+mov rax, [rbx+1]
+DB 1e, 2.`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.DD, "DD"},
+		{token.FLOAT, "1.5"},
+		{token.COMMA, ","},
+		{token.FLOAT, "3e8"},
+		{token.COMMA, ","},
+		{token.FLOAT, "6.02e+23"},
+		{token.COMMA, ","},
+		{token.FLOAT, "1e-3"},
+		{token.COMMA, ","},
+		{token.FLOAT, "0x1.8p3"},
+		{token.COMMA, ","},
+		{token.FLOAT, "0x1.cp-1"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "3"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.LSQUARE, "["},
+		{token.REGISTER, "rbx"},
+		{token.PLUS, "+"},
+		{token.NUMBER, "1"},
+		{token.DB, "DB"},
+		{token.NUMBER, "1"},
+		{token.IDENTIFIER, "e"},
+		{token.COMMA, ","},
+		{token.NUMBER, "2"},
+		{token.ILLEGAL, "unterminated label"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestLocalLabels(t *testing.T) {
+
+	input := `:.loop
+jmp .loop
+jmp print_string.loop
+jmp 1b
+jmp 12f
+DQ .first, .second
+DB 1bz`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.LABEL, ".loop"},
+		{token.INSTRUCTION, "jmp"},
+		{token.DATA, "loop"},
+		{token.INSTRUCTION, "jmp"},
+		{token.IDENTIFIER, "print_string.loop"},
+		{token.INSTRUCTION, "jmp"},
+		{token.NUMBER, "1b"},
+		{token.INSTRUCTION, "jmp"},
+		{token.NUMBER, "12f"},
+		{token.DQ, "DQ"},
+		{token.DATA, "first"},
+		{token.COMMA, ","},
+		{token.DATA, "second"},
+		{token.DB, "DB"},
+		{token.NUMBER, "1"},
+		{token.IDENTIFIER, "bz"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestNumbers(t *testing.T) {
+
+	input := `mov rax, 0xff
+mov rax, 0b1010
+mov rax, 0o17
+mov rax, 0ffh
+mov rax, 0bbh
+mov rax, 1010b
+mov rax, 17q
+mov rax, 1_000_000
+mov rax, 'A'
+mov rax, '\n'
+mov rax, '\''
+mov rax, -1
+DD 1e3
+mov rax, 'ab'`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "0xff"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "0b1010"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "0o17"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "0ffh"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "0bbh"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "1010b"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "17q"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "1_000_000"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "65"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "10"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.NUMBER, "39"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.MINUS, "-"},
+		{token.NUMBER, "1"},
+		{token.DD, "DD"},
+		{token.FLOAT, "1e3"},
+		{token.INSTRUCTION, "mov"},
+		{token.REGISTER, "rax"},
+		{token.COMMA, ","},
+		{token.ILLEGAL, "character constants must contain a single character, got 'ab'"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// An escaped newline within a string, or character constant, doesn't
+// begin a new line.
+func TestEscapedNewline(t *testing.T) {
+
+	input := `DB "a\n", 1
+mov al, '\n'
+nop`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+		expectedLine    int
+	}{
+		{token.DB, "DB", 1},
+		{token.STRING, "a\n", 1},
+		{token.COMMA, ",", 1},
+		{token.NUMBER, "1", 1},
+		{token.INSTRUCTION, "mov", 2},
+		{token.REGISTER, "al", 2},
+		{token.COMMA, ",", 2},
+		{token.NUMBER, "10", 2},
+		{token.INSTRUCTION, "nop", 3},
+		{token.EOF, "", 3},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - Line wrong, expected=%d, got=%d", i, tt.expectedLine, tok.Line)
+		}
+	}
+}
+
+// Names which contain "-" can't be referred to, so they're errors.
+func TestLabelHyphen(t *testing.T) {
+
+	tests := map[string]token.Type{
+		":foo-bar\n":    token.ILLEGAL,
+		".foo-bar DB 1": token.ILLEGAL,
+		":foo-bar, nop": token.ILLEGAL,
+		":foo_bar\n":    token.LABEL,
+		".foo_bar DB 1": token.DATA,
+		":..@3.loop\n":  token.LABEL,
+		":%%loop\n":     token.LABEL,
+	}
+
+	for input, expected := range tests {
+		tok := New(input).NextToken()
+		if tok.Type != expected {
+			t.Fatalf("wrong token for %s, expected %s, got %v", input, expected, tok)
+		}
+		if expected == token.ILLEGAL && !strings.Contains(tok.Literal, "may not contain '-'") {
+			t.Fatalf("wrong error for %s, got %s", input, tok.Literal)
+		}
+	}
+
+	// References are subtractions.
+	l := New("jmp foo-bar")
+	for _, expected := range []token.Type{token.INSTRUCTION, token.IDENTIFIER, token.MINUS, token.IDENTIFIER} {
+		tok := l.NextToken()
+		if tok.Type != expected {
+			t.Fatalf("wrong token, expected %s, got %v", expected, tok)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 
+	"github.com/skx/assembler/expr"
 	"github.com/skx/assembler/token"
 )
 
@@ -23,19 +24,47 @@ func (e Error) String() string {
 	return fmt.Sprintf("<ERROR:%s>", e.Value)
 }
 
-// Data holds a data-statement, which might look like either of these:
+// Data holds a data-statement, which might look like any of these:
 //
-//   .foo DB "Steve"
+//   .foo DB "Steve", 10, 0
 //   .bar DB 0x030, 0x40, 0x90
+//   .baz DQ 0x1234
+//   DB 0x00
 //
+// The last of which has no name.
 type Data struct {
 	Node
 
 	// Name is the name of the data-section
 	Name string
 
+	// Size is the size of each value, in bits.
+	Size int
+
 	// Contents holds the string/byte data for the reference
 	Contents []byte
+
+	// References holds any values within the contents which can
+	// only be calculated once the program has been laid out.
+	References []Reference
+}
+
+// Reference holds a value within some data which refers to labels, or
+// other data, and so must be calculated once the program has been laid
+// out.  For example:
+//
+//   .foo DB end - start
+//
+type Reference struct {
+
+	// Offset is the position of the value within the data.
+	Offset int
+
+	// Size is the size of the value, in bits.
+	Size int
+
+	// Value is the expression which must be evaluated.
+	Value expr.Expression
 }
 
 // String outputs this Data structure as a string.
@@ -43,6 +72,141 @@ func (d Data) String() string {
 	return fmt.Sprintf("<DATA: name:%s data:%v>", d.Name, d.Contents)
 }
 
+// Reserve holds a reservation of uninitialised storage, which is placed
+// in the bss segment rather than the binary.  For example:
+//
+//   .buffer RESB 4096
+//
+type Reserve struct {
+	Node
+
+	// Name is the name of the storage, which may be empty.
+	Name string
+
+	// Size is the size of each value, in bits.
+	Size int
+
+	// Count is the number of values to reserve.
+	Count expr.Expression
+}
+
+// String outputs this Reserve structure as a string.
+func (r Reserve) String() string {
+	return fmt.Sprintf("<RESERVE: name:%s size:%d count:%s>", r.Name, r.Size, r.Count)
+}
+
+// Constant holds the definition of a named constant, for example:
+//
+//   hello_len equ $ - hello
+//
+type Constant struct {
+	Node
+
+	// Name is the name of the constant.
+	Name string
+
+	// Value is the value of the constant.
+	Value expr.Expression
+}
+
+// String outputs this Constant structure as a string.
+func (c Constant) String() string {
+	return fmt.Sprintf("<CONSTANT: name:%s value:%s>", c.Name, c.Value)
+}
+
+// Align holds an alignment of the current position, for example:
+//
+//   align 16
+//   alignb 8
+//
+type Align struct {
+	Node
+
+	// Boundary is the value the position must be a multiple of.
+	Boundary expr.Expression
+
+	// Zero is true if the padding is always zeros, as for `alignb`,
+	// rather than NOP instructions within code.
+	Zero bool
+}
+
+// String outputs this Align structure as a string.
+func (a Align) String() string {
+	return fmt.Sprintf("<ALIGN: boundary:%s zero:%t>", a.Boundary, a.Zero)
+}
+
+// Section holds the name of the section into which the following code,
+// or data, is placed.  For example:
+//
+//   section .rodata
+//
+type Section struct {
+	Node
+
+	// Name is the name of the section, including the leading ".".
+	Name string
+}
+
+// String outputs this Section structure as a string.
+func (s Section) String() string {
+	return fmt.Sprintf("<SECTION: name:%s>", s.Name)
+}
+
+// Entry holds the name of the label at which execution begins, for
+// example:
+//
+//   entry main
+//
+type Entry struct {
+	Node
+
+	// Name is the name of the label.
+	Name string
+}
+
+// String outputs this Entry structure as a string.
+func (e Entry) String() string {
+	return fmt.Sprintf("<ENTRY: name:%s>", e.Name)
+}
+
+// Global holds the names of labels which are declared global, for
+// example:
+//
+//   global _start
+//
+type Global struct {
+	Node
+
+	// Names holds the names of the labels.
+	Names []string
+}
+
+// String outputs this Global structure as a string.
+func (g Global) String() string {
+	return fmt.Sprintf("<GLOBAL: names:%v>", g.Names)
+}
+
+// Times holds an instruction, or data-statement, which is repeated.
+// For example:
+//
+//   times 4 nop
+//   times 510 - ($ - $$) DB 0
+//
+type Times struct {
+	Node
+
+	// Count is the number of times the statement is repeated.
+	Count expr.Expression
+
+	// Statement is the instruction, or data, which is repeated.
+	Statement Node
+}
+
+// String outputs this Times structure as a string.
+func (t Times) String() string {
+	return fmt.Sprintf("<TIMES: count:%s statement:%s>", t.Count, t.Statement)
+}
+
 // Operand is used to hold the operand for an instruction.
 //
 // Some instructions have zero operands (e.g. `nop`), others have
@@ -51,6 +215,9 @@ func (d Data) String() string {
 //
 type Operand struct {
 	// Token contains our parent token.
+	//
+	// For a memory-operand this is the base-register, if one is
+	// present.
 	token.Token
 
 	// If we're operating upon memory-addresses we need to be
@@ -64,12 +231,68 @@ type Operand struct {
 	//   word -> 16 bits.
 	//  dword -> 32 bites.
 	//  qword -> 64 bites.
+	//
+	// Numbers may also be given a size, for example `push dword 1`.
 	Size int
 
+	// Strict is true if the size of a number must be used for its
+	// encoding, as in `add rbx, strict dword 1`.  Otherwise we'll use
+	// the shortest encoding which can hold the value.
+	Strict bool
+
 	// Is indirection used?
 	//
 	// i.e. `rax` has no indirection, but `[rax]` does.
 	Indirection bool
+
+	// Segment holds the name of the segment-register which is
+	// used to override the default segment of a memory-access.
+	//
+	// For example `mov rax, fs:[0x28]` will use the `fs` segment.
+	Segment string
+
+	// Displacement holds the offset which is added to the address of
+	// a memory-operand.
+	//
+	// For example `[rbp-8]` has a displacement of -8, and the absolute
+	// address `[0x28]` has a displacement of 0x28.
+	Displacement int64
+
+	// Index holds the name of the index-register of a memory-operand,
+	// and Scale holds the value it is multiplied by.
+	//
+	// For example `[table + rax*8]` has an index of `rax`, and a
+	// scale of 8.
+	Index string
+	Scale int
+
+	// Symbol holds the name of a label, or data-item, whose address
+	// is added to the displacement of a memory-operand.
+	//
+	// For example `[table + rax*8]` refers to the symbol `table`.
+	Symbol string
+
+	// RIPRelative is true if the memory-operand is addressed relative
+	// to the instruction pointer, as in `call [rel func_ptr]`.
+	RIPRelative bool
+
+	// Expression holds the value of an operand which refers to labels,
+	// or data, and so cannot be calculated until the program has been
+	// laid out.
+	//
+	// For a number this is the whole value, as in `mov rdx, end - start`,
+	// and for a memory-operand it is the displacement, as in
+	// `[rbx + (table - base) * 2]`.  A plain reference to a symbol in a
+	// memory-operand, with an optional offset, is stored in Symbol and
+	// Displacement instead.
+	Expression expr.Expression
+
+	// DisplacementSize holds the size, in bits, which must be used to
+	// encode the displacement of a memory-operand.  This is set via
+	// an encoding-option such as `{disp32} mov rax, [rbx+8]`.
+	//
+	// When this is zero the shortest encoding will be used.
+	DisplacementSize int
 }
 
 // Instruction holds a parsed instruction.
@@ -3,14 +3,38 @@
 package parser
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
+	"math/big"
 	"strconv"
+	"strings"
 
+	"github.com/skx/assembler/expr"
 	"github.com/skx/assembler/instructions"
-	"github.com/skx/assembler/lexer"
+	"github.com/skx/assembler/preprocessor"
 	"github.com/skx/assembler/token"
 )
 
+// dataSizes holds the size, in bits, of the values stored by each of the
+// data-statements.
+var dataSizes = map[token.Type]int{
+	token.DB: 8,
+	token.DW: 16,
+	token.DD: 32,
+	token.DQ: 64,
+	token.DT: 80,
+}
+
+// reserveSizes holds the size, in bits, of the values reserved by each
+// of the reservation-statements.
+var reserveSizes = map[token.Type]int{
+	token.RESB: 8,
+	token.RESW: 16,
+	token.RESD: 32,
+	token.RESQ: 64,
+}
+
 // Parser holds our state.
 type Parser struct {
 	// program holds our lexed program, as a series of tokens.
@@ -19,31 +43,185 @@ type Parser struct {
 	// position holds our current offset within the program
 	// above.
 	position int
+
+	// pre holds the preprocessor which produced our program, which
+	// knows the location of each line within the source.
+	pre *preprocessor.Preprocessor
+
+	// line holds the line upon which the statement most recently
+	// returned by Next began.
+	line int
+
+	// scopes holds the name of the label which precedes each token
+	// of the program, which local labels are scoped to.
+	scopes []string
+
+	// constants holds the values of the constants defined via `equ`
+	// which we've been able to calculate, so that they may be used
+	// anywhere a number can be.
+	constants map[string]int64
 }
 
 // New creates a new Parser, which will parse the specified
 // input program into a series of tokens, and then allow it
 // to be parsed.
 func New(input string) *Parser {
+	return NewWithPreprocessor(input, preprocessor.New())
+}
 
-	// Create our parser
-	p := &Parser{}
+// NewWithPreprocessor creates a new Parser, which will use the given
+// preprocessor to handle the directives within the input program.
+//
+// This allows the caller to configure the preprocessor, for example
+// with the directories which `%include` searches.
+func NewWithPreprocessor(input string, pre *preprocessor.Preprocessor) *Parser {
 
-	// Create the lexer object.
-	l := lexer.New(input)
+	// Create our parser
+	p := &Parser{constants: make(map[string]int64), pre: pre}
 
-	// Parse our program into a series of tokens
-	tok := l.NextToken()
-	for tok.Type != token.EOF {
-		p.program = append(p.program, tok)
-		tok = l.NextToken()
-	}
+	// Preprocess our program, which lexes it into a series of
+	// tokens, and carries out any directives.  Then give local,
+	// and anonymous, labels their full names.
+	p.program, p.scopes = scope(pre.Process(input))
 
 	// Now we have a parser complete with a series of tokens
 	return p
 
 }
 
+// scope qualifies the names of local labels, which begin with ".", with
+// the name of the preceding label, and gives each anonymous label, such
+// as `:1`, a unique name.  References to anonymous labels are updated to
+// match, and the name of the label which precedes each token is returned
+// so that references to local labels may be updated as they're parsed:
+//
+//   :print_string
+//   :.loop              ; print_string.loop
+//      jmp .loop
+//   :1
+//      jmp 1b           ; the preceding `:1`
+//      jmp 1f           ; the following `:1`
+//
+// Macro-local labels, which begin with "..@", are left alone.
+func scope(program []token.Token) ([]token.Token, []string) {
+
+	// The number of anonymous labels with each name, so that
+	// references to the following label may be found.
+	total := make(map[string]int)
+	for _, tok := range program {
+		if tok.Type == token.LABEL && anonymous(tok.Literal) {
+			total[tok.Literal]++
+		}
+	}
+
+	// The number of anonymous labels seen so far.
+	seen := make(map[string]int)
+
+	out := make([]token.Token, len(program))
+	scopes := make([]string, len(program))
+	global := ""
+	for i, tok := range program {
+
+		switch {
+
+		case tok.Type == token.LABEL && anonymous(tok.Literal):
+			seen[tok.Literal]++
+			tok.Literal = fmt.Sprintf("%s@%d", tok.Literal, seen[tok.Literal])
+
+		case tok.Type == token.LABEL && strings.HasPrefix(tok.Literal, "..@"):
+
+		case tok.Type == token.LABEL && strings.HasPrefix(tok.Literal, "."):
+			if global == "" {
+				tok = token.Token{Type: token.ILLEGAL, Literal: fmt.Sprintf("local label %s has no preceding label", tok.Literal), Line: tok.Line}
+				break
+			}
+			tok.Literal = global + tok.Literal
+
+		case tok.Type == token.LABEL:
+			global = tok.Literal
+
+		// A reference to an anonymous label is the target of
+		// a jump, or call.
+		case tok.Type == token.NUMBER && i > 0 && branch(program[i-1]):
+			name := tok.Literal[:len(tok.Literal)-1]
+			if !anonymous(name) || !strings.ContainsAny(tok.Literal[len(name):], "bf") {
+				break
+			}
+
+			n := seen[name]
+			if strings.HasSuffix(tok.Literal, "f") {
+				n++
+			}
+			if n < 1 || n > total[name] {
+				tok = token.Token{Type: token.ILLEGAL, Literal: fmt.Sprintf("reference to unknown anonymous label %s", tok.Literal), Line: tok.Line}
+				break
+			}
+			tok = token.Token{Type: token.IDENTIFIER, Literal: fmt.Sprintf("%s@%d", name, n), Line: tok.Line}
+		}
+
+		out[i] = tok
+		scopes[i] = global
+	}
+	return out, scopes
+}
+
+// anonymous returns true if the given label-name is that of an anonymous
+// label, which consists only of digits.
+func anonymous(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// branch returns true if the given token is an instruction which jumps,
+// or calls, to a label.
+func branch(tok token.Token) bool {
+	return tok.Type == token.INSTRUCTION &&
+		(tok.Literal == "call" ||
+			strings.HasPrefix(tok.Literal, "j") ||
+			strings.HasPrefix(tok.Literal, "loop"))
+}
+
+// expression parses the expression which begins at the current position,
+// returning it along with the number of tokens which were consumed.
+//
+// Data tokens within an expression are references to local labels,
+// rather than definitions, so they're given their full names first.
+func (p *Parser) expression() (expr.Expression, int, error) {
+
+	var toks []token.Token
+	for i := p.position; i < len(p.program); i++ {
+
+		tok := p.program[i]
+		if tok.Line != p.program[p.position].Line {
+			break
+		}
+
+		if tok.Type == token.DATA {
+			if p.scopes[i] == "" {
+				tok = token.Token{Type: token.ILLEGAL, Literal: fmt.Sprintf("local label .%s has no preceding label", tok.Literal), Line: tok.Line}
+			} else {
+				tok = token.Token{Type: token.IDENTIFIER, Literal: p.scopes[i] + "." + tok.Literal, Line: tok.Line}
+			}
+		}
+		toks = append(toks, tok)
+	}
+
+	return expr.Parse(toks)
+}
+
+// starts returns true if the given token may start an expression, which
+// includes references to local labels.
+func starts(tok token.Token) bool {
+	return expr.Starts(tok) || tok.Type == token.DATA
+}
+
 // Next returns the stream of parsed "things" from the input source program.
 //
 // The things we return include:
@@ -51,21 +229,73 @@ func New(input string) *Parser {
 //  * Instructions.
 //  * Label definitions.
 //  * Data references.
+//  * Constant definitions.
+//  * Repeated instructions, or data.
+//  * Reservations of uninitialised storage.
+//  * Section changes, and alignment.
+//  * The entry-point, and global labels.
 //
 // There might be more things in the future.
+//
+// Errors begin with the location of the statement which caused them.
 func (p *Parser) Next() Node {
 
+	node := p.next()
+
+	if e, ok := node.(Error); ok {
+		e.Value = p.Location() + ": " + e.Value
+		return e
+	}
+	return node
+}
+
+// Location returns the location, within the source, of the statement
+// most recently returned by Next:
+//
+//   hello.asm:3
+//   syscalls.inc:3 (included from hello.asm:1)
+func (p *Parser) Location() string {
+	return p.pre.Location(p.line)
+}
+
+// next returns the next statement, for Next.
+func (p *Parser) next() Node {
+
 	// Loop until we've exhausted our input.
 	for p.position < len(p.program) {
 
 		// The token we're operating upon
 		tok := p.program[p.position]
+		p.line = tok.Line
 
 		switch tok.Type {
 
-		case token.DATA:
+		case token.DATA, token.DB, token.DW, token.DD, token.DQ, token.DT:
 			return p.parseData()
 
+		case token.RESB, token.RESW, token.RESD, token.RESQ:
+			return p.parseReserve("")
+
+		case token.ALIGN, token.ALIGNB:
+			return p.parseAlign()
+
+		case token.ENCODING:
+			return p.parseEncoding()
+
+		case token.ENTRY:
+			return p.parseEntry()
+
+		case token.GLOBAL:
+			return p.parseGlobal()
+
+		case token.IDENTIFIER:
+			return p.parseConstant()
+
+		// Errors found by the lexer, or preprocessor.
+		case token.ILLEGAL:
+			p.position++
+			return Error{Value: tok.Literal}
+
 		case token.INSTRUCTION:
 			return p.parseInstruction()
 
@@ -75,39 +305,317 @@ func (p *Parser) Next() Node {
 		case token.RSQUARE:
 			p.position++
 
+		case token.SECTION:
+			return p.parseSection()
+
+		case token.TIMES:
+			return p.parseTimes()
+
 		default:
-			fmt.Printf("Unhandled thing - definite bug: %v\n", tok)
+			p.position++
+			return Error{Value: fmt.Sprintf("unexpected token %v", tok)}
 		}
 	}
 
 	return nil
 }
 
-// parseData handles input of the form:
+// parseConstant handles input of the form:
 //
-//  .NAME DB "String content here"
+//  NAME equ 1 + 2
+func (p *Parser) parseConstant() Node {
+
+	name := p.program[p.position]
+
+	// skip the name
+	p.position++
+
+	// Next token should be EQU
+	if p.position >= len(p.program) ||
+		p.program[p.position].Type != token.EQU {
+		return Error{Value: fmt.Sprintf("unexpected token %v", name)}
+	}
+	p.position++
+
+	e, n, err := p.expression()
+	if err != nil {
+		return Error{Value: fmt.Sprintf("error parsing value of %s: %s", name.Literal, err)}
+	}
+	p.position += n
+
+	if len(expr.Registers(e)) > 0 {
+		return Error{Value: fmt.Sprintf("registers cannot be used in constants: %s", e)}
+	}
+
+	// If we can calculate the value now then we'll remember it.
+	num, ok, err := p.constant(e)
+	if err != nil {
+		return Error{Value: fmt.Sprintf("error calculating value of %s: %s", name.Literal, err)}
+	}
+	if ok {
+		p.constants[name.Literal] = num
+	}
+
+	return Constant{Name: name.Literal, Value: e}
+}
+
+// parseSection handles input of the form:
 //
-// TODO:
+//   section .data
+func (p *Parser) parseSection() Node {
+
+	// skip the SECTION
+	p.position++
+
+	if p.position >= len(p.program) {
+		return Error{Value: "Unexpected EOF parsing section"}
+	}
+
+	// The name looks like the name of some data.
+	name := p.program[p.position]
+	if name.Type != token.DATA {
+		return Error{Value: fmt.Sprintf("expected section name, got %v", name)}
+	}
+	p.position++
+
+	return Section{Name: "." + name.Literal}
+}
+
+// parseAlign handles input of the form:
 //
-//  .NAME DB 0x01, 0x02, 0x03 ...
-func (p *Parser) parseData() Node {
+//   align 16
+//   alignb 4 * 2
+func (p *Parser) parseAlign() Node {
+
+	a := Align{Zero: p.program[p.position].Type == token.ALIGNB}
 
-	// create the data-structure, with the name.
-	d := Data{Name: p.program[p.position].Literal}
+	// skip the ALIGN
+	p.position++
+
+	e, n, err := p.expression()
+	if err != nil {
+		return Error{Value: fmt.Sprintf("error parsing boundary for alignment: %s", err)}
+	}
+	p.position += n
 
-	// skip the DATA
+	if len(expr.Registers(e)) > 0 {
+		return Error{Value: fmt.Sprintf("registers cannot be used in the boundary for alignment: %s", e)}
+	}
+
+	a.Boundary = e
+	return a
+}
+
+// parseEntry handles input of the form:
+//
+//   entry main
+func (p *Parser) parseEntry() Node {
+
+	// skip the ENTRY
 	p.position++
 
-	// ensure we're not out of the program
 	if p.position >= len(p.program) {
-		return Error{Value: "Unexpected EOF parsing data"}
+		return Error{Value: "Unexpected EOF parsing entry"}
+	}
+
+	name := p.program[p.position]
+	if name.Type != token.IDENTIFIER && !token.IsDirective(name.Type) {
+		return Error{Value: fmt.Sprintf("expected label name after entry, got %v", name)}
+	}
+	p.position++
+
+	return Entry{Name: name.Literal}
+}
+
+// parseGlobal handles input of the form:
+//
+//   global _start
+//   global _start, main
+func (p *Parser) parseGlobal() Node {
+
+	// skip the GLOBAL
+	p.position++
+
+	var g Global
+	for {
+		if p.position >= len(p.program) {
+			return Error{Value: "Unexpected EOF parsing global"}
+		}
+
+		name := p.program[p.position]
+		if name.Type != token.IDENTIFIER && !token.IsDirective(name.Type) {
+			return Error{Value: fmt.Sprintf("expected label name after global, got %v", name)}
+		}
+		p.position++
+		g.Names = append(g.Names, name.Literal)
+
+		// if the next token is not a comma then we're done
+		if p.position >= len(p.program) ||
+			p.program[p.position].Type != token.COMMA {
+			return g
+		}
+
+		// Otherwise skip over the comma
+		p.position++
+	}
+}
+
+// parseTimes handles an instruction, or data-statement, which is
+// repeated:
+//
+//   times 4 nop
+//   times 510 - ($ - $$) DB 0
+func (p *Parser) parseTimes() Node {
+
+	// skip the TIMES
+	p.position++
+
+	e, n, err := p.expression()
+	if err != nil {
+		return Error{Value: fmt.Sprintf("error parsing count for times: %s", err)}
+	}
+	p.position += n
+
+	if len(expr.Registers(e)) > 0 {
+		return Error{Value: fmt.Sprintf("registers cannot be used in the count for times: %s", e)}
+	}
+
+	if p.position >= len(p.program) {
+		return Error{Value: "Unexpected EOF parsing times"}
+	}
+
+	var stmt Node
+	switch p.program[p.position].Type {
+	case token.INSTRUCTION:
+		stmt = p.parseInstruction()
+	case token.DB, token.DW, token.DD, token.DQ, token.DT:
+		stmt = p.parseData()
+	default:
+		return Error{Value: fmt.Sprintf("expected instruction or data after times, got %v", p.program[p.position])}
+	}
+
+	if _, ok := stmt.(Error); ok {
+		return stmt
+	}
+	return Times{Count: e, Statement: stmt}
+}
+
+// parseNamedTimes handles a data-statement which is repeated, and named:
+//
+//   .buffer times 64 DB 0
+func (p *Parser) parseNamedTimes(name string) Node {
+
+	stmt := p.parseTimes()
+
+	t, ok := stmt.(Times)
+	if !ok {
+		return stmt
+	}
+	d, ok := t.Statement.(Data)
+	if !ok {
+		return Error{Value: fmt.Sprintf("expected data after .%s times, got %v", name, t.Statement)}
+	}
+
+	d.Name = name
+	t.Statement = d
+	return t
+}
+
+// constant returns the value of the given expression, if it can be
+// calculated now.  This is the case if it contains no registers, and
+// refers to no symbols other than the constants we've already seen.
+func (p *Parser) constant(e expr.Expression) (int64, bool, error) {
+
+	if len(expr.Registers(e)) > 0 {
+		return 0, false, nil
+	}
+	for _, name := range expr.Symbols(e) {
+		if _, ok := p.constants[name]; !ok {
+			return 0, false, nil
+		}
+	}
+
+	num, err := expr.Evaluate(e, func(name string) (int64, error) {
+		return p.constants[name], nil
+	})
+	return num, err == nil, err
+}
+
+// parseReserve handles the reservation of uninitialised storage, which
+// has the given name, if any:
+//
+//  .NAME RESB 64
+//  RESQ 4 * 8
+func (p *Parser) parseReserve(name string) Node {
+
+	size := reserveSizes[p.program[p.position].Type]
+
+	// skip the RESB, etc.
+	p.position++
+
+	e, n, err := p.expression()
+	if err != nil {
+		return Error{Value: fmt.Sprintf("error parsing count for reservation: %s", err)}
+	}
+	p.position += n
+
+	if len(expr.Registers(e)) > 0 {
+		return Error{Value: fmt.Sprintf("registers cannot be used in the count for a reservation: %s", e)}
+	}
+
+	return Reserve{Name: name, Size: size, Count: e}
+}
+
+// parseData handles input of the form:
+//
+//  .NAME DB "String content here"
+//  .NAME DB 0x01, 0x02, 0x03 ...
+//  .NAME DB end - start, 4 * 8
+//  .NAME DB "String", 10, 0
+//  .NAME DW 0x1234, 0x5678
+//  .NAME DD 0x12345678
+//  .NAME DQ 0x1234567812345678
+//  .NAME DD 1.5, -2.25
+//  .NAME DT 3.14159
+func (p *Parser) parseData() Node {
+
+	var d Data
+
+	// Data may be anonymous, but if it has a name then record it.
+	if p.program[p.position].Type == token.DATA {
+
+		// create the data-structure, with the name.
+		d.Name = p.program[p.position].Literal
+
+		// skip the DATA
+		p.position++
+
+		// ensure we're not out of the program
+		if p.position >= len(p.program) {
+			return Error{Value: "Unexpected EOF parsing data"}
+		}
+
+		// Repeated data is named once:
+		//   .foo times 4 DB 0
+		if p.program[p.position].Type == token.TIMES {
+			return p.parseNamedTimes(d.Name)
+		}
+
+		// Storage may be reserved:
+		//   .buffer RESB 64
+		if _, ok := reserveSizes[p.program[p.position].Type]; ok {
+			return p.parseReserve(d.Name)
+		}
 	}
 
-	// Next token should be DB
+	// Next token should be DB, DW, DD, DQ, or DT, which gives the
+	// size of each value.
 	db := p.program[p.position]
-	if db.Type != token.DB {
-		return Error{Value: fmt.Sprintf("expected DB, got %v", db)}
+	size, ok := dataSizes[db.Type]
+	if !ok {
+		return Error{Value: fmt.Sprintf("expected DB, DW, DD, DQ, DT, or RESB, RESW, RESD, RESQ, got %v", db)}
 	}
+	d.Size = size
 
 	// move forward
 	p.position++
@@ -116,41 +624,81 @@ func (p *Parser) parseData() Node {
 	}
 
 	//
-	// We support:
-	//   .foo DB "String"
+	// We support a list of strings and numbers:
+	//   .foo DB "String", 10, 0
 	//
 	// Or
-	//   .foo DB 0x03, 0x4...
+	//   .foo DW 0x03, 0x4...
 	//
-	// If the next token is a string handle that.
-	cur := p.program[p.position]
-	if cur.Type == token.STRING {
-		// bump past the string
-		p.position++
+	for {
 
-		d.Contents = []byte(cur.Literal)
-		return d
-	}
+		cur := p.program[p.position]
 
-	// If the type isn't a number that's an error
-	if cur.Type != token.NUMBER {
-		return Error{Value: fmt.Sprintf("expected string|number-array, got %v", cur)}
-	}
+		switch {
 
-	// OK so we've got number
-	for cur.Type == token.NUMBER {
+		case cur.Type == token.STRING:
+			// bump past the string
+			p.position++
 
-		// Parse it
-		num, err := strconv.ParseInt(cur.Literal, 0, 64)
-		if err != nil {
-			return Error{Value: fmt.Sprintf("failed to convert '%s' to number:%s", cur.Literal, err)}
-		}
+			// Strings are padded to a multiple of the size
+			// of each value.
+			d.Contents = append(d.Contents, []byte(cur.Literal)...)
+			for len(d.Contents)%(size/8) != 0 {
+				d.Contents = append(d.Contents, 0)
+			}
+
+		case p.float():
+
+			// Floating-point numbers may be negated.
+			negative := cur.Type == token.MINUS
+			if cur.Type != token.FLOAT {
+				p.position++
+			}
+
+			buf, err := float(p.program[p.position].Literal, negative, size)
+			if err != nil {
+				return Error{Value: err.Error()}
+			}
+			p.position++
 
-		// Add to the array
-		d.Contents = append(d.Contents, byte(num))
+			d.Contents = append(d.Contents, buf...)
+
+		case size == 80:
+			return Error{Value: fmt.Sprintf("DT only accepts floating-point numbers, got %v", cur)}
+
+		case starts(cur):
+
+			// Parse it
+			e, n, err := p.expression()
+			if err != nil {
+				return Error{Value: err.Error()}
+			}
+			p.position += n
+
+			if len(expr.Registers(e)) > 0 {
+				return Error{Value: fmt.Sprintf("registers cannot be used in data: %s", e)}
+			}
+
+			// If the value isn't known yet it must be calculated later
+			num, ok, err := p.constant(e)
+			if err != nil {
+				return Error{Value: err.Error()}
+			}
+			if !ok {
+				d.References = append(d.References, Reference{Offset: len(d.Contents), Size: size, Value: e})
+			}
+			if size < 64 && (num < int64(-1)<<(size-1) || num > int64(1)<<size-1) {
+				return Error{Value: fmt.Sprintf("value %d does not fit in %d bits", num, size)}
+			}
+
+			// Add to the array, in little-endian order
+			buf := make([]byte, 8)
+			binary.LittleEndian.PutUint64(buf, uint64(num))
+			d.Contents = append(d.Contents, buf[:size/8]...)
 
-		// skip past the number
-		p.position++
+		default:
+			return Error{Value: fmt.Sprintf("expected string|number, got %v", cur)}
+		}
 
 		// end of program?
 		if p.position >= len(p.program) {
@@ -169,13 +717,94 @@ func (p *Parser) parseData() Node {
 		if p.position >= len(p.program) {
 			break
 		}
-
-		cur = p.program[p.position]
 	}
 
 	return d
 }
 
+// float returns true if we're looking at a floating-point number, which
+// might be preceded by a sign.
+func (p *Parser) float() bool {
+
+	tok := p.program[p.position]
+	if tok.Type == token.MINUS || tok.Type == token.PLUS {
+		if p.position+1 >= len(p.program) {
+			return false
+		}
+		tok = p.program[p.position+1]
+	}
+	return tok.Type == token.FLOAT
+}
+
+// float encodes the given floating-point number, as a little-endian
+// IEEE-754 value of the given size in bits.
+//
+// 32 and 64-bit values are the single and double-precision formats, and
+// 80-bit values are the x87 extended-precision format.
+func float(literal string, negative bool, size int) ([]byte, error) {
+
+	// Hexadecimal numbers must have an exponent to be parsed.
+	if strings.HasPrefix(strings.ToLower(literal), "0x") && !strings.ContainsAny(literal, "pP") {
+		literal += "p0"
+	}
+
+	switch size {
+
+	case 32, 64:
+		f, err := strconv.ParseFloat(literal, size)
+		if err != nil {
+			if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
+				return nil, fmt.Errorf("floating-point number %s is out of range", literal)
+			}
+			return nil, fmt.Errorf("invalid floating-point number %s", literal)
+		}
+		if negative {
+			f = -f
+		}
+
+		buf := make([]byte, 8)
+		if size == 32 {
+			binary.LittleEndian.PutUint32(buf, math.Float32bits(float32(f)))
+			return buf[:4], nil
+		}
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(f))
+		return buf, nil
+
+	case 80:
+		// We parse with the 64-bit precision of the format.
+		f, _, err := big.ParseFloat(literal, 0, 64, big.ToNearestEven)
+		if err != nil {
+			return nil, fmt.Errorf("invalid floating-point number %s", literal)
+		}
+
+		buf := make([]byte, 10)
+		sign := uint16(0)
+		if negative {
+			sign = 0x8000
+		}
+
+		// Zero has no exponent, or mantissa.
+		if f.Sign() == 0 {
+			binary.LittleEndian.PutUint16(buf[8:], sign)
+			return buf, nil
+		}
+
+		// The mantissa has an explicit leading one-bit.
+		mant := new(big.Float)
+		exp := f.MantExp(mant) + 16382
+		if exp <= 0 || exp >= 0x7fff {
+			return nil, fmt.Errorf("floating-point number %s is out of range", literal)
+		}
+		bits, _ := mant.SetMantExp(mant, 64).Uint64()
+
+		binary.LittleEndian.PutUint64(buf, bits)
+		binary.LittleEndian.PutUint16(buf[8:], sign|uint16(exp))
+		return buf, nil
+	}
+
+	return nil, fmt.Errorf("floating-point numbers must be stored via DD, DQ, or DT")
+}
+
 // parseInstruction is our workhorse
 //
 // We either return an `Instruction` or an `Error`
@@ -193,32 +822,68 @@ func (p *Parser) parseInstruction() Node {
 		return Error{Value: fmt.Sprintf("unknown instructoin %v", tok)}
 	}
 
+	// Some instructions have optional operands.
+	min, ok := instructions.MinimumLengths[tok.Literal]
+	if !ok {
+		min = count
+	}
+
 	// No args?  Just return the instruction and bump the position
 	if count == 0 {
 		p.position++
 		return Instruction{Instruction: tok.Literal}
 	}
 
-	if count == 1 {
-		args, err := p.TakeOneArgument()
-		if err != nil {
-			return Error{Value: err.Error()}
+	args, err := p.TakeArguments(min, count)
+	if err != nil {
+		return Error{Value: err.Error()}
+	}
+	return Instruction{Instruction: tok.Literal, Operands: args}
+}
+
+// parseEncoding handles encoding-options which prefix an instruction,
+// for example:
+//
+//  {disp32} mov rax, [rbx+8]
+func (p *Parser) parseEncoding() Node {
+
+	size := 0
+
+	for p.position < len(p.program) &&
+		p.program[p.position].Type == token.ENCODING {
 
+		opt := p.program[p.position].Literal
+		switch opt {
+		case "disp8":
+			size = 8
+		case "disp32":
+			size = 32
+		default:
+			p.position++
+			return Error{Value: fmt.Sprintf("unknown encoding-option {%s}", opt)}
 		}
+		p.position++
+	}
 
-		return Instruction{Instruction: tok.Literal, Operands: args}
+	// Now we need the instruction
+	if p.position >= len(p.program) ||
+		p.program[p.position].Type != token.INSTRUCTION {
+		return Error{Value: "expected instruction after encoding-option"}
 	}
-	if count == 2 {
 
-		args, err := p.TakeTwoArguments()
-		if err != nil {
-			return Error{Value: err.Error()}
+	node := p.parseInstruction()
+	ins, ok := node.(Instruction)
+	if !ok {
+		return node
+	}
 
+	// Apply the option to any memory-operands
+	for n := range ins.Operands {
+		if ins.Operands[n].Indirection {
+			ins.Operands[n].DisplacementSize = size
 		}
-		return Instruction{Instruction: tok.Literal, Operands: args}
 	}
-
-	return Error{Value: fmt.Sprintf("unhandled argument-count for token %v", tok)}
+	return ins
 }
 
 // parseLabel handles input of the form:
@@ -235,52 +900,66 @@ func (p *Parser) parseLabel() Node {
 	return l
 }
 
-// TakeTwoArguments handles fetching two arguments for an instruction.
+// TakeArguments reads between min and max arguments for an instruction.
 //
-// Arguments may be register-names, numbers, or label-values
-func (p *Parser) TakeTwoArguments() ([]Operand, error) {
+// Arguments may be register-names, numbers, memory-references, or
+// label-values.  Optional arguments are only consumed if they are found
+// upon the same line as the instruction itself.
+func (p *Parser) TakeArguments(min int, max int) ([]Operand, error) {
 
 	var toks []Operand
 
-	// Get the first argument
-	one, err := p.getOperand()
-	if err != nil {
-		return toks, err
-	}
-	toks = append(toks, one)
-
-	// see if we have a comma
-	c := p.program[p.position]
-	if c.Type != token.COMMA {
-		return toks, fmt.Errorf("expected ',', got %v", c)
-	}
+	// The line the instruction is upon
+	line := p.program[p.position].Line
+
+	for len(toks) < max {
+
+		if len(toks) == 0 {
+
+			// Is there an (optional) argument?
+			if len(toks) >= min &&
+				(p.position+1 >= len(p.program) ||
+					p.program[p.position+1].Line != line) {
+				p.position++
+				break
+			}
+		} else {
+
+			// Subsequent arguments must follow a comma
+			if p.position >= len(p.program) ||
+				p.program[p.position].Type != token.COMMA {
+				if len(toks) >= min {
+					break
+				}
+				if p.position >= len(p.program) {
+					return toks, fmt.Errorf("expected ',', got EOF")
+				}
+				return toks, fmt.Errorf("expected ',', got %v", p.program[p.position])
+			}
+		}
 
-	// Get the second argument
-	two, err := p.getOperand()
-	if err != nil {
-		return toks, err
+		arg, err := p.getOperand()
+		if err != nil {
+			return toks, err
+		}
+		toks = append(toks, arg)
 	}
-	toks = append(toks, two)
 
 	return toks, nil
 }
 
+// TakeTwoArguments handles fetching two arguments for an instruction.
+//
+// Arguments may be register-names, numbers, or label-values
+func (p *Parser) TakeTwoArguments() ([]Operand, error) {
+	return p.TakeArguments(2, 2)
+}
+
 // TakeOneArgument reads the argument for a single-arg instruction.
 //
 // Arguments may be a register-name, number, or a label-value.
 func (p *Parser) TakeOneArgument() ([]Operand, error) {
-
-	var toks []Operand
-
-	// Get the argument
-	one, err := p.getOperand()
-
-	if err != nil {
-		return toks, err
-	}
-	toks = append(toks, one)
-
-	return toks, nil
+	return p.TakeArguments(1, 1)
 }
 
 func (p *Parser) getOperand() (Operand, error) {
@@ -296,21 +975,38 @@ func (p *Parser) getOperand() (Operand, error) {
 	// Get the argument
 	thing := p.program[p.position]
 
-	if thing.Type == token.REGISTER ||
-		thing.Type == token.NUMBER {
+	if thing.Type == token.REGISTER {
 		op.Token = thing
 		p.position++
 		return op, nil
 	}
 
+	// A memory-operand, with no explicit size.
+	if thing.Type == token.LSQUARE ||
+		thing.Type == token.SEGMENT {
+		return p.parseMemory(op)
+	}
+
+	// A number which must use a specific size?
+	if thing.Type == token.IDENTIFIER && thing.Literal == "strict" {
+		op.Strict = true
+
+		p.position++
+		if p.position >= len(p.program) {
+			return op, fmt.Errorf("unexpected EOF after strict")
+		}
+		thing = p.program[p.position]
+	}
+
 	// Could be "identifer", could be "byte|word|qword ptr"
 	if thing.Literal != "byte" &&
 		thing.Literal != "word" &&
 		thing.Literal != "dword" &&
 		thing.Literal != "qword" {
-		op.Token = thing
-		p.position++
-		return op, nil
+		if op.Strict {
+			return op, fmt.Errorf("expected size after strict, got %v", thing)
+		}
+		return p.parseImmediate(op)
 	}
 
 	// OK indirection.  probably
@@ -327,7 +1023,7 @@ func (p *Parser) getOperand() (Operand, error) {
 		op.Size = 64
 	}
 
-	// So the next token must be "ptr"
+	// So the next token must be "ptr", or a number
 	p.position++
 	if p.position >= len(p.program) {
 		return op, fmt.Errorf("unexpected EOF #2")
@@ -336,25 +1032,339 @@ func (p *Parser) getOperand() (Operand, error) {
 	// Get the next arg
 	next := p.program[p.position]
 	if next.Type != token.IDENTIFIER || next.Literal != "ptr" {
+		if starts(next) {
+			return p.parseImmediate(op)
+		}
 		return op, fmt.Errorf("expected ptr after %s", thing.Literal)
 	}
+	if op.Strict {
+		return op, fmt.Errorf("strict may only be used with numbers")
+	}
 	p.position++
 
-	if p.program[p.position].Type == token.LSQUARE {
-		op.Indirection = true
+	return p.parseMemory(op)
+}
+
+// parseImmediate handles an operand which is a number, a reference to a
+// label or data, or an expression involving them:
+//
+//   16
+//   label
+//   (end - start) / 8
+//
+// Expressions which can be calculated now are replaced by a number,
+// otherwise the expression is saved for the compiler to calculate once
+// the program has been laid out.
+func (p *Parser) parseImmediate(op Operand) (Operand, error) {
+
+	start := p.program[p.position]
+
+	// Errors, such as a reference to an unknown anonymous label
+	if start.Type == token.ILLEGAL {
+		return op, fmt.Errorf("%s", start.Literal)
+	}
 
-		// skip the [
+	// Not an expression?  Then we'll leave it to the compiler
+	if !starts(start) {
+		op.Token = start
 		p.position++
+		return op, nil
+	}
+
+	e, n, err := p.expression()
+	if err != nil {
+		return op, err
+	}
+	p.position += n
+
+	if len(expr.Registers(e)) > 0 {
+		return op, fmt.Errorf("registers may only be used in memory-operands: %s", e)
+	}
+
+	num, ok, err := p.constant(e)
+	if err != nil {
+		return op, err
+	}
+
+	switch {
+
+	// A plain number keeps its literal
+	case ok && n == 1 && start.Type == token.NUMBER:
+		op.Token = start
 
-		// get the register + skip it
-		op.Token = p.program[p.position]
+	case ok:
+		op.Token = token.Token{Type: token.NUMBER, Literal: strconv.FormatInt(num, 10), Line: start.Line}
+
+	default:
+		op.Token = token.Token{Type: token.IDENTIFIER, Literal: e.String(), Line: start.Line}
+		op.Expression = e
+	}
+
+	return op, nil
+}
+
+// parseMemory handles a memory-operand, which might have a
+// displacement, an index, or a segment-override:
+//
+//   [rax]
+//   [rbp+16]
+//   [rbp-8]
+//   [0x28]
+//   fs:[0x28]
+//   [table + rax*8]
+//   [rbx + rcx*4 + 8]
+//   [rel func_ptr]
+//   [rbx + (end - start) * 2]
+//
+// The size of the operand will already have been set by our caller,
+// if it was specified.
+func (p *Parser) parseMemory(op Operand) (Operand, error) {
+
+	if p.position >= len(p.program) {
+		return op, fmt.Errorf("unexpected EOF parsing memory-operand")
+	}
+
+	// Segment override?
+	if p.program[p.position].Type == token.SEGMENT {
+		op.Segment = p.program[p.position].Literal
 		p.position++
 
-	} else {
+		// Which must be followed by ":"
+		if p.position >= len(p.program) ||
+			p.program[p.position].Type != token.COLON {
+			return op, fmt.Errorf("expected ':' after segment %s", op.Segment)
+		}
 		p.position++
-		op.Token = p.program[p.position]
+	}
+
+	if p.position >= len(p.program) ||
+		p.program[p.position].Type != token.LSQUARE {
+		return op, fmt.Errorf("expected '[' for memory-operand")
+	}
+	op.Indirection = true
+
+	// skip the [
+	p.position++
+
+	// RIP-relative?
+	if p.position < len(p.program) &&
+		p.program[p.position].Type == token.IDENTIFIER &&
+		p.program[p.position].Literal == "rel" {
+		op.RIPRelative = true
 		p.position++
 	}
+
+	if p.position >= len(p.program) {
+		return op, fmt.Errorf("unexpected EOF parsing memory-operand")
+	}
+
+	// The address is an expression, which we split into terms
+	// separated by "+" or "-".
+	line := p.program[p.position].Line
+	e, n, err := p.expression()
+	if err != nil {
+		return op, err
+	}
+	p.position += n
+
+	var terms []term
+	splitTerms(e, false, &terms)
+
+	// The base-register, and whatever remains once the registers
+	// are removed.
+	var base token.Token
+	var disp expr.Expression
+
+	for _, t := range terms {
+
+		// Not a register?  Then part of the displacement.
+		if len(expr.Registers(t.value)) == 0 {
+			switch {
+			case disp == nil && t.negate:
+				disp = expr.Unary{Operator: "-", Right: t.value}
+			case disp == nil:
+				disp = t.value
+			case t.negate:
+				disp = expr.Binary{Operator: "-", Left: disp, Right: t.value}
+			default:
+				disp = expr.Binary{Operator: "+", Left: disp, Right: t.value}
+			}
+			continue
+		}
+
+		if t.negate {
+			return op, fmt.Errorf("registers cannot be subtracted in memory-operand")
+		}
+
+		switch v := t.value.(type) {
+
+		case expr.Register:
+
+			// The base, or an unscaled index.
+			if base.Type == "" {
+				base = token.Token{Type: token.REGISTER, Literal: v.Name, Line: line}
+			} else if op.Index == "" {
+				op.Index = v.Name
+				op.Scale = 1
+			} else {
+				return op, fmt.Errorf("too many registers in memory-operand")
+			}
+
+		case expr.Binary:
+
+			// A scaled index, which might be written either way
+			// around: rax*8, or 8*rax.
+			reg, ok := v.Left.(expr.Register)
+			scale := v.Right
+			if !ok {
+				reg, ok = v.Right.(expr.Register)
+				scale = v.Left
+			}
+			if v.Operator != "*" || !ok {
+				return op, fmt.Errorf("invalid use of register in memory-operand %s", v)
+			}
+
+			num, known, err := p.constant(scale)
+			if err != nil {
+				return op, err
+			}
+			if !known {
+				return op, fmt.Errorf("invalid index-register in memory-operand %s", v)
+			}
+			if op.Index != "" {
+				return op, fmt.Errorf("multiple index-registers in memory-operand")
+			}
+			op.Index = reg.Name
+			op.Scale = int(num)
+
+		default:
+			return op, fmt.Errorf("invalid use of register in memory-operand %s", v)
+		}
+	}
+
+	// Now work out the displacement, which is either a number, a
+	// symbol with an optional offset, or an expression which must
+	// be calculated later.
+	if disp != nil {
+		num, ok, err := p.constant(disp)
+		if err != nil {
+			return op, err
+		}
+
+		switch {
+		case ok:
+			op.Displacement = num
+		default:
+			op.Symbol, op.Displacement, ok = symbolOffset(disp)
+			if !ok {
+				op.Symbol = ""
+				op.Expression = disp
+			}
+		}
+	}
+
+	// rsp cannot be used as an index, but we can swap it into the
+	// base-position if it wasn't scaled.
+	if op.Index == "rsp" && op.Scale == 1 && base.Type != "" {
+		op.Index = base.Literal
+		base.Literal = "rsp"
+	}
+
+	// Save the base-register, or the first thing we found.
+	first, found := firstNumber(disp)
+	switch {
+	case base.Type != "":
+		op.Token = base
+	case op.Symbol != "":
+		op.Token = token.Token{Type: token.IDENTIFIER, Literal: op.Symbol}
+	case op.Expression != nil:
+		op.Token = token.Token{Type: token.IDENTIFIER, Literal: op.Expression.String()}
+	case found:
+		op.Token = first
+	default:
+		op.Token = token.Token{Type: token.NUMBER, Literal: "0"}
+	}
+
+	if op.RIPRelative && (base.Type != "" || op.Index != "") {
+		return op, fmt.Errorf("rip-relative memory-operands cannot use registers")
+	}
+
 	return op, nil
+}
 
+// term is one of the terms of the address in a memory-operand.
+type term struct {
+	value  expr.Expression
+	negate bool
+}
+
+// splitTerms splits the given address into the terms which are added,
+// or subtracted, to form it.
+func splitTerms(e expr.Expression, negate bool, terms *[]term) {
+
+	switch v := e.(type) {
+
+	case expr.Binary:
+		if v.Operator == "+" || v.Operator == "-" {
+			splitTerms(v.Left, negate, terms)
+			splitTerms(v.Right, negate != (v.Operator == "-"), terms)
+			return
+		}
+
+	case expr.Unary:
+		if v.Operator == "-" {
+			splitTerms(v.Right, !negate, terms)
+			return
+		}
+	}
+
+	*terms = append(*terms, term{value: e, negate: negate})
+}
+
+// symbolOffset returns the symbol, and offset, of a displacement which
+// is a plain reference to a symbol with an optional numeric offset, for
+// example `table`, or `table + 8`.
+func symbolOffset(e expr.Expression) (string, int64, bool) {
+
+	switch v := e.(type) {
+
+	case expr.Symbol:
+		return v.Name, 0, true
+
+	case expr.Binary:
+		sym, ok := v.Left.(expr.Symbol)
+		if !ok || (v.Operator != "+" && v.Operator != "-") {
+			return "", 0, false
+		}
+
+		num, ok, err := expr.Constant(v.Right)
+		if !ok || err != nil {
+			return "", 0, false
+		}
+		if v.Operator == "-" {
+			num = -num
+		}
+		return sym.Name, num, true
+	}
+
+	return "", 0, false
+}
+
+// firstNumber returns the token of the first number in the given
+// expression, if there is one.
+func firstNumber(e expr.Expression) (token.Token, bool) {
+
+	switch v := e.(type) {
+	case expr.Number:
+		return v.Token, true
+	case expr.Unary:
+		return firstNumber(v.Right)
+	case expr.Binary:
+		tok, ok := firstNumber(v.Left)
+		if ok {
+			return tok, true
+		}
+		return firstNumber(v.Right)
+	}
+	return token.Token{}, false
 }
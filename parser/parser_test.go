@@ -1,7 +1,10 @@
 package parser
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/skx/assembler/token"
 )
 
 func TestComment(t *testing.T) {
@@ -34,6 +37,57 @@ func TestData(t *testing.T) {
 		TestCase{Input: ".foo DB 32, ",
 			Data: []byte{32},
 		},
+		TestCase{Input: ".foo DB \"Hi\", 10, 0",
+			Data: []byte{72, 105, 10, 0},
+		},
+		TestCase{Input: ".foo DB 1, \"Hi\", \"!\"",
+			Data: []byte{1, 72, 105, 33},
+		},
+		TestCase{Input: ".foo DW 258, 3",
+			Data: []byte{2, 1, 3, 0},
+		},
+		TestCase{Input: ".foo DD 16909060",
+			Data: []byte{4, 3, 2, 1},
+		},
+		TestCase{Input: ".foo DQ 1, 0 - 1",
+			Data: []byte{1, 0, 0, 0, 0, 0, 0, 0, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		TestCase{Input: ".foo DW \"abc\"",
+			Data: []byte{97, 98, 99, 0},
+		},
+		TestCase{Input: ".foo DD \"abc\", 1",
+			Data: []byte{97, 98, 99, 0, 1, 0, 0, 0},
+		},
+		TestCase{Input: ".foo DB 255, 0 - 128",
+			Data: []byte{255, 128},
+		},
+		TestCase{Input: ".foo DW 65535",
+			Data: []byte{255, 255},
+		},
+		TestCase{Input: "dw 7",
+			Data: []byte{7, 0},
+		},
+		TestCase{Input: ".f DD 1.5, -2.0",
+			Data: []byte{0, 0, 0xc0, 0x3f, 0, 0, 0, 0xc0},
+		},
+		TestCase{Input: ".f DD 0x1.8p1",
+			Data: []byte{0, 0, 0x40, 0x40},
+		},
+		TestCase{Input: ".f DQ 3.14159, 1e3",
+			Data: []byte{0x6e, 0x86, 0x1b, 0xf0, 0xf9, 0x21, 0x09, 0x40, 0, 0, 0, 0, 0, 0x40, 0x8f, 0x40},
+		},
+		TestCase{Input: ".f DQ 1, 0.5",
+			Data: []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xe0, 0x3f},
+		},
+		TestCase{Input: ".f DT 1.0, -0.0",
+			Data: []byte{0, 0, 0, 0, 0, 0, 0, 0x80, 0xff, 0x3f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80},
+		},
+		TestCase{Input: ".f DT 3.14159265358979323846",
+			Data: []byte{0x35, 0xc2, 0x68, 0x21, 0xa2, 0xda, 0x0f, 0xc9, 0x00, 0x40},
+		},
+		TestCase{Input: ".f DT -0x1p-2",
+			Data: []byte{0, 0, 0, 0, 0, 0, 0, 0x80, 0xfd, 0xbf},
+		},
 	}
 
 	// For each test
@@ -89,3 +143,973 @@ func TestMove(t *testing.T) {
 		t.Fatalf("mov - wrong second arg")
 	}
 }
+
+func TestSegment(t *testing.T) {
+
+	type TestCase struct {
+		Input   string
+		Segment string
+		Size    int
+		Literal string
+	}
+
+	tests := []TestCase{
+		TestCase{Input: "mov rax, fs:[0x28]", Segment: "fs", Size: 0, Literal: "0x28"},
+		TestCase{Input: "mov rax, qword ptr gs:[0]", Segment: "gs", Size: 64, Literal: "0"},
+		TestCase{Input: "mov rax, dword ptr [rbx]", Segment: "", Size: 32, Literal: "rbx"},
+	}
+
+	for _, test := range tests {
+
+		p := New(test.Input)
+		out := p.Next()
+
+		i, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction structure for %s: %v", test.Input, out)
+		}
+		if len(i.Operands) != 2 {
+			t.Fatalf("wrong arg count for %s", test.Input)
+		}
+
+		op := i.Operands[1]
+		if !op.Indirection {
+			t.Fatalf("expected indirection for %s", test.Input)
+		}
+		if op.Segment != test.Segment {
+			t.Fatalf("wrong segment for %s, got %s", test.Input, op.Segment)
+		}
+		if op.Size != test.Size {
+			t.Fatalf("wrong size for %s, got %d", test.Input, op.Size)
+		}
+		if op.Literal != test.Literal {
+			t.Fatalf("wrong address for %s, got %s", test.Input, op.Literal)
+		}
+	}
+
+	// Errors
+	bad := []string{
+		"mov rax, fs[0x28]",
+		"mov rax, fs:rax",
+		"mov rax, qword ptr fs:",
+	}
+	for _, test := range bad {
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected error parsing %s, got %v", test, out)
+		}
+	}
+}
+
+func TestOptionalOperands(t *testing.T) {
+
+	p := New(`ret
+ret 16
+:label
+ret`)
+
+	// ret
+	out := p.Next()
+	i, ok := out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction structure: %v", out)
+	}
+	if len(i.Operands) != 0 {
+		t.Fatalf("ret - wrong arg count")
+	}
+
+	// ret 16
+	out = p.Next()
+	i, ok = out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction structure: %v", out)
+	}
+	if len(i.Operands) != 1 || i.Operands[0].Literal != "16" {
+		t.Fatalf("ret 16 - wrong args %v", i.Operands)
+	}
+
+	// label
+	out = p.Next()
+	if _, ok = out.(Label); !ok {
+		t.Fatalf("didn't get a label: %v", out)
+	}
+
+	// ret at EOF
+	out = p.Next()
+	i, ok = out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction structure: %v", out)
+	}
+	if len(i.Operands) != 0 {
+		t.Fatalf("ret - wrong arg count")
+	}
+
+	if p.Next() != nil {
+		t.Fatalf("expected end of program")
+	}
+}
+
+func TestDisplacement(t *testing.T) {
+
+	type TestCase struct {
+		Input        string
+		Register     string
+		Displacement int64
+	}
+
+	tests := []TestCase{
+		TestCase{Input: "push qword ptr [rbp+16]", Register: "rbp", Displacement: 16},
+		TestCase{Input: "push [rbp-8]", Register: "rbp", Displacement: -8},
+		TestCase{Input: "push [rbx+8-2]", Register: "rbx", Displacement: 6},
+		TestCase{Input: "push [0x28+8]", Register: "0x28", Displacement: 0x30},
+	}
+
+	for _, test := range tests {
+
+		p := New(test.Input)
+		out := p.Next()
+
+		i, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction structure for %s: %v", test.Input, out)
+		}
+
+		op := i.Operands[0]
+		if op.Literal != test.Register {
+			t.Fatalf("wrong register for %s, got %s", test.Input, op.Literal)
+		}
+		if op.Displacement != test.Displacement {
+			t.Fatalf("wrong displacement for %s, got %d", test.Input, op.Displacement)
+		}
+	}
+
+	// Errors
+	p := New("push [rbp+rax+rbx]")
+	out := p.Next()
+	if _, ok := out.(Error); !ok {
+		t.Fatalf("expected error, got %v", out)
+	}
+}
+
+func TestIndexed(t *testing.T) {
+
+	type TestCase struct {
+		Input        string
+		Base         string
+		Index        string
+		Scale        int
+		Symbol       string
+		Displacement int64
+		Relative     bool
+	}
+
+	tests := []TestCase{
+		TestCase{Input: "jmp [rbx]", Base: "rbx"},
+		TestCase{Input: "jmp qword ptr [table + rax*8]", Index: "rax", Scale: 8, Symbol: "table"},
+		TestCase{Input: "jmp [rbx + rcx*4 + 8]", Base: "rbx", Index: "rcx", Scale: 4, Displacement: 8},
+		TestCase{Input: "jmp [2*rcx + rbx]", Base: "rbx", Index: "rcx", Scale: 2},
+		TestCase{Input: "jmp [rbx + rsi]", Base: "rbx", Index: "rsi", Scale: 1},
+		TestCase{Input: "jmp [rax + rsp]", Base: "rsp", Index: "rax", Scale: 1},
+		TestCase{Input: "call [rel func_ptr]", Symbol: "func_ptr", Relative: true},
+		TestCase{Input: "call [rel func_ptr + 8]", Symbol: "func_ptr", Displacement: 8, Relative: true},
+		TestCase{Input: "jmp [rbx + (4 + 4) * 2]", Base: "rbx", Displacement: 16},
+		TestCase{Input: "jmp [rbx + rcx*(1 << 2) - 8]", Base: "rbx", Index: "rcx", Scale: 4, Displacement: -8},
+		TestCase{Input: "jmp [table - 8 + rax*8]", Index: "rax", Scale: 8, Symbol: "table", Displacement: -8},
+	}
+
+	for _, test := range tests {
+
+		p := New(test.Input)
+		out := p.Next()
+
+		i, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction structure for %s: %v", test.Input, out)
+		}
+
+		op := i.Operands[0]
+		if test.Base != "" && (op.Type != token.REGISTER || op.Literal != test.Base) {
+			t.Fatalf("wrong base for %s, got %v", test.Input, op.Token)
+		}
+		if test.Base == "" && op.Type == token.REGISTER {
+			t.Fatalf("unexpected base for %s, got %v", test.Input, op.Token)
+		}
+		if op.Index != test.Index || op.Scale != test.Scale {
+			t.Fatalf("wrong index for %s, got %s*%d", test.Input, op.Index, op.Scale)
+		}
+		if op.Symbol != test.Symbol {
+			t.Fatalf("wrong symbol for %s, got %s", test.Input, op.Symbol)
+		}
+		if op.Displacement != test.Displacement {
+			t.Fatalf("wrong displacement for %s, got %d", test.Input, op.Displacement)
+		}
+		if op.RIPRelative != test.Relative {
+			t.Fatalf("wrong rip-relative setting for %s", test.Input)
+		}
+	}
+
+	// Errors
+	bad := []string{
+		"jmp [rel rax]",
+		"jmp [rbx - rax]",
+		"jmp [rax*2 + rbx*4]",
+		"jmp [rax * rbx]",
+		"jmp [rax * label]",
+		"jmp [(rax + 1) * 2]",
+		"jmp [rax *]",
+	}
+	for _, test := range bad {
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected error parsing %s, got %v", test, out)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Size   int
+		Strict bool
+	}
+
+	tests := []TestCase{
+		TestCase{Input: "add rbx, 1", Size: 0, Strict: false},
+		TestCase{Input: "add rbx, dword 1", Size: 32, Strict: false},
+		TestCase{Input: "add rbx, strict dword 1", Size: 32, Strict: true},
+		TestCase{Input: "add rbx, strict byte 1", Size: 8, Strict: true},
+	}
+
+	for _, test := range tests {
+
+		p := New(test.Input)
+		out := p.Next()
+
+		i, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction structure for %s: %v", test.Input, out)
+		}
+
+		op := i.Operands[1]
+		if op.Type != token.NUMBER || op.Literal != "1" {
+			t.Fatalf("wrong operand for %s, got %v", test.Input, op.Token)
+		}
+		if op.Size != test.Size || op.Strict != test.Strict {
+			t.Fatalf("wrong size for %s, got %d/%t", test.Input, op.Size, op.Strict)
+		}
+	}
+
+	// Errors
+	bad := []string{
+		"add rbx, strict 1",
+		"add rbx, strict dword ptr [rax]",
+	}
+	for _, test := range bad {
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected error parsing %s, got %v", test, out)
+		}
+	}
+}
+
+func TestEncodingOptions(t *testing.T) {
+
+	p := New(`{disp32} mov rax, [rbx+8]
+{disp8} push [rbp]
+{disp16} nop
+{disp32}`)
+
+	out := p.Next()
+	i, ok := out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction structure: %v", out)
+	}
+	if i.Operands[0].DisplacementSize != 0 || i.Operands[1].DisplacementSize != 32 {
+		t.Fatalf("wrong displacement-size %v", i.Operands)
+	}
+
+	out = p.Next()
+	i, ok = out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction structure: %v", out)
+	}
+	if i.Operands[0].DisplacementSize != 8 {
+		t.Fatalf("wrong displacement-size %v", i.Operands)
+	}
+
+	out = p.Next()
+	if _, ok := out.(Error); !ok {
+		t.Fatalf("expected error, got %v", out)
+	}
+	out = p.Next()
+	if _, ok := out.(Instruction); !ok {
+		t.Fatalf("expected instruction, got %v", out)
+	}
+	out = p.Next()
+	if _, ok := out.(Error); !ok {
+		t.Fatalf("expected error, got %v", out)
+	}
+}
+
+func TestExpressions(t *testing.T) {
+
+	type TestCase struct {
+		Input      string
+		Literal    string
+		Type       token.Type
+		Expression bool
+	}
+
+	tests := []TestCase{
+		TestCase{Input: "mov rax, 0x10", Type: token.NUMBER, Literal: "0x10"},
+		TestCase{Input: "mov rax, (1 + 2) * 4", Type: token.NUMBER, Literal: "12"},
+		TestCase{Input: "mov rax, ~0", Type: token.NUMBER, Literal: "-1"},
+		TestCase{Input: "push dword 1 << 8", Type: token.NUMBER, Literal: "256"},
+		TestCase{Input: "push label", Type: token.IDENTIFIER, Literal: "label", Expression: true},
+		TestCase{Input: "mov rdx, end - start", Type: token.IDENTIFIER, Literal: "(end - start)", Expression: true},
+		TestCase{Input: "jmp [rbx + (end - start)]", Type: token.REGISTER, Literal: "rbx", Expression: true},
+	}
+
+	for _, test := range tests {
+
+		p := New(test.Input)
+		out := p.Next()
+
+		i, ok := out.(Instruction)
+		if !ok {
+			t.Fatalf("didn't get an instruction structure for %s: %v", test.Input, out)
+		}
+
+		op := i.Operands[len(i.Operands)-1]
+		if op.Type != test.Type || op.Literal != test.Literal {
+			t.Fatalf("wrong operand for %s, got %v", test.Input, op.Token)
+		}
+		if (op.Expression != nil) != test.Expression {
+			t.Fatalf("wrong expression for %s, got %v", test.Input, op.Expression)
+		}
+	}
+
+	// Errors
+	bad := []string{
+		"mov rax, (1 + 2",
+		"mov rax, 1 / 0",
+		"mov rax, 3 +",
+	}
+	for _, test := range bad {
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected error parsing %s, got %v", test, out)
+		}
+	}
+}
+
+func TestDataExpressions(t *testing.T) {
+
+	p := New(`.foo DB 1 + 2, 4 * 4, end - start, 7`)
+	out := p.Next()
+
+	d, ok := out.(Data)
+	if !ok {
+		t.Fatalf("didn't get a data structure: %v", out)
+	}
+	if len(d.Contents) != 4 || d.Contents[0] != 3 || d.Contents[1] != 16 || d.Contents[3] != 7 {
+		t.Fatalf("wrong data contents: %v", d.Contents)
+	}
+	if len(d.References) != 1 || d.References[0].Offset != 2 || d.References[0].Size != 8 {
+		t.Fatalf("wrong data references: %v", d.References)
+	}
+}
+
+// Test that labels, and other addresses, may be stored in data.
+func TestDataReferences(t *testing.T) {
+
+	p := New(`.table DQ case0, case1, 7
+.offsets DD case1 - base, 3, end - start`)
+
+	out := p.Next()
+	d, ok := out.(Data)
+	if !ok {
+		t.Fatalf("didn't get a data structure: %v", out)
+	}
+	if len(d.Contents) != 24 || d.Contents[16] != 7 {
+		t.Fatalf("wrong data contents: %v", d.Contents)
+	}
+	if len(d.References) != 2 ||
+		d.References[0].Offset != 0 || d.References[0].Size != 64 || d.References[0].Value.String() != "case0" ||
+		d.References[1].Offset != 8 || d.References[1].Size != 64 || d.References[1].Value.String() != "case1" {
+		t.Fatalf("wrong data references: %v", d.References)
+	}
+
+	out = p.Next()
+	d, ok = out.(Data)
+	if !ok {
+		t.Fatalf("didn't get a data structure: %v", out)
+	}
+	if len(d.Contents) != 12 || d.Contents[4] != 3 {
+		t.Fatalf("wrong data contents: %v", d.Contents)
+	}
+	if len(d.References) != 2 ||
+		d.References[0].Offset != 0 || d.References[0].Size != 32 || d.References[0].Value.String() != "(case1 - base)" ||
+		d.References[1].Offset != 8 || d.References[1].Size != 32 {
+		t.Fatalf("wrong data references: %v", d.References)
+	}
+}
+
+func TestConstant(t *testing.T) {
+
+	p := New(`hello_len equ $ - hello
+SYS_WRITE EQU 4
+foo bar
+missing equ`)
+
+	out := p.Next()
+	c, ok := out.(Constant)
+	if !ok {
+		t.Fatalf("didn't get a constant: %v", out)
+	}
+	if c.Name != "hello_len" || c.Value.String() != "($ - hello)" {
+		t.Fatalf("wrong constant: %v", c)
+	}
+
+	out = p.Next()
+	c, ok = out.(Constant)
+	if !ok {
+		t.Fatalf("didn't get a constant: %v", out)
+	}
+	if c.Name != "SYS_WRITE" || c.Value.String() != "4" {
+		t.Fatalf("wrong constant: %v", c)
+	}
+
+	// An identifier which isn't followed by equ
+	out = p.Next()
+	if _, ok := out.(Error); !ok {
+		t.Fatalf("expected an error, got %v", out)
+	}
+
+	// Skip the stray identifier
+	p.Next()
+
+	// A constant with no value
+	out = p.Next()
+	if _, ok := out.(Error); !ok {
+		t.Fatalf("expected an error, got %v", out)
+	}
+}
+
+func TestConstantValues(t *testing.T) {
+
+	p := New(`SCALE equ 4
+SIZE equ SCALE * 2
+%define BASE rbx
+mov rax, SIZE + 1
+mov rax, [BASE + rcx*SCALE + SIZE]
+mov rax, LATER`)
+
+	// Skip the constants
+	p.Next()
+	p.Next()
+
+	out := p.Next()
+	i, ok := out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction: %v", out)
+	}
+	if i.Operands[1].Type != token.NUMBER || i.Operands[1].Literal != "9" {
+		t.Fatalf("constant wasn't calculated: %v", i.Operands[1])
+	}
+
+	out = p.Next()
+	i, ok = out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction: %v", out)
+	}
+	op := i.Operands[1]
+	if op.Literal != "rbx" || op.Index != "rcx" || op.Scale != 4 || op.Displacement != 8 || op.Symbol != "" {
+		t.Fatalf("constants weren't calculated: %v", op)
+	}
+
+	// A constant which isn't known yet is left for the compiler
+	out = p.Next()
+	i, ok = out.(Instruction)
+	if !ok {
+		t.Fatalf("didn't get an instruction: %v", out)
+	}
+	if i.Operands[1].Expression == nil {
+		t.Fatalf("expected an expression: %v", i.Operands[1])
+	}
+}
+
+func TestTimes(t *testing.T) {
+
+	p := New(`times 4 nop
+times 510 - ($ - $$) DB 0
+.buffer times 64 DB 1, 2
+DB 3`)
+
+	out := p.Next()
+	tm, ok := out.(Times)
+	if !ok {
+		t.Fatalf("didn't get times: %v", out)
+	}
+	if tm.Count.String() != "4" {
+		t.Fatalf("wrong count: %v", tm)
+	}
+	if i, ok := tm.Statement.(Instruction); !ok || i.Instruction != "nop" {
+		t.Fatalf("wrong statement: %v", tm)
+	}
+
+	out = p.Next()
+	tm, ok = out.(Times)
+	if !ok {
+		t.Fatalf("didn't get times: %v", out)
+	}
+	if tm.Count.String() != "(510 - ($ - $$))" {
+		t.Fatalf("wrong count: %v", tm)
+	}
+	if d, ok := tm.Statement.(Data); !ok || d.Name != "" || len(d.Contents) != 1 {
+		t.Fatalf("wrong statement: %v", tm)
+	}
+
+	out = p.Next()
+	tm, ok = out.(Times)
+	if !ok {
+		t.Fatalf("didn't get times: %v", out)
+	}
+	if d, ok := tm.Statement.(Data); !ok || d.Name != "buffer" || len(d.Contents) != 2 {
+		t.Fatalf("wrong statement: %v", tm)
+	}
+
+	// Anonymous data
+	out = p.Next()
+	d, ok := out.(Data)
+	if !ok || d.Name != "" || d.Contents[0] != 3 {
+		t.Fatalf("wrong data: %v", out)
+	}
+}
+
+func TestTimesErrors(t *testing.T) {
+
+	tests := []string{
+		"times",
+		"times 4",
+		"times rax nop",
+		"times 4 :label",
+		"times 4 foo equ 3",
+		".foo times 4 nop",
+		"times 4 mov rax",
+	}
+
+	for _, test := range tests {
+
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error for '%s', got %v", test, out)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+
+	p := New(`.buffer RESB 64
+resw 2 * 4
+.ptrs resd 1
+.big RESQ count`)
+
+	tests := []struct {
+		name  string
+		size  int
+		count string
+	}{
+		{"buffer", 8, "64"},
+		{"", 16, "(2 * 4)"},
+		{"ptrs", 32, "1"},
+		{"big", 64, "count"},
+	}
+
+	for _, test := range tests {
+
+		out := p.Next()
+		r, ok := out.(Reserve)
+		if !ok {
+			t.Fatalf("didn't get reservation: %v", out)
+		}
+		if r.Name != test.name || r.Size != test.size || r.Count.String() != test.count {
+			t.Fatalf("wrong reservation, expected %v, got %v", test, r)
+		}
+	}
+
+	if out := p.Next(); out != nil {
+		t.Fatalf("unexpected output: %v", out)
+	}
+}
+
+func TestReserveErrors(t *testing.T) {
+
+	tests := []string{
+		"resb",
+		".foo RESB",
+		".foo RESQ rax",
+		".foo RESD (",
+		"times 4 resb 1",
+	}
+
+	for _, test := range tests {
+
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error for '%s', got %v", test, out)
+		}
+	}
+}
+
+func TestSection(t *testing.T) {
+
+	p := New(`section .text
+nop
+SECTION .rodata
+section .my_data`)
+
+	tests := []string{".text", "", ".rodata", ".my_data"}
+
+	for _, test := range tests {
+
+		out := p.Next()
+		if test == "" {
+			if _, ok := out.(Instruction); !ok {
+				t.Fatalf("didn't get instruction: %v", out)
+			}
+			continue
+		}
+
+		s, ok := out.(Section)
+		if !ok {
+			t.Fatalf("didn't get section: %v", out)
+		}
+		if s.Name != test {
+			t.Fatalf("wrong section, expected %s, got %s", test, s.Name)
+		}
+	}
+
+	// Errors
+	for _, test := range []string{"section", "section text", "section 3", "section \"x\""} {
+
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error for '%s', got %v", test, out)
+		}
+	}
+}
+
+func TestEntry(t *testing.T) {
+
+	p := New(`entry main
+global _start
+GLOBAL _start, main`)
+
+	out := p.Next()
+	e, ok := out.(Entry)
+	if !ok || e.Name != "main" {
+		t.Fatalf("didn't get entry: %v", out)
+	}
+
+	out = p.Next()
+	g, ok := out.(Global)
+	if !ok || len(g.Names) != 1 || g.Names[0] != "_start" {
+		t.Fatalf("didn't get global: %v", out)
+	}
+
+	out = p.Next()
+	g, ok = out.(Global)
+	if !ok || len(g.Names) != 2 || g.Names[1] != "main" {
+		t.Fatalf("didn't get global: %v", out)
+	}
+
+	// Errors
+	for _, test := range []string{"entry", "entry 3", "entry :main", "global", "global _start,", "global rax"} {
+
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error for '%s', got %v", test, out)
+		}
+	}
+}
+
+func TestLocalLabels(t *testing.T) {
+
+	p := New(`:print_string
+:.loop
+  jmp .loop
+.table DQ .loop, .done
+:.done
+:other
+:.loop
+:1
+  jmp 1b
+  jne 1f
+  call 1f
+:1
+  loop 1b
+  mov rax, 1`)
+
+	tests := []string{
+		"<LABEL: print_string>",
+		"<LABEL: print_string.loop>",
+		"jmp print_string.loop",
+		"<DATA: name:table data:[0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0]>",
+		"<LABEL: print_string.done>",
+		"<LABEL: other>",
+		"<LABEL: other.loop>",
+		"<LABEL: 1@1>",
+		"jmp 1@1",
+		"jne 1@2",
+		"call 1@2",
+		"<LABEL: 1@2>",
+		"loop 1@2",
+		"mov rax",
+	}
+
+	for _, test := range tests {
+
+		out := p.Next()
+		if i, ok := out.(Instruction); ok {
+			got := i.Instruction + " " + i.Operands[0].Literal
+			if got != test {
+				t.Fatalf("wrong instruction, expected %s, got %s", test, got)
+			}
+			continue
+		}
+		if out.String() != test {
+			t.Fatalf("wrong output, expected %s, got %s", test, out)
+		}
+	}
+
+	// The references within the data
+	p = New(`:print_string
+.table DQ .loop, .done`)
+	p.Next()
+	d := p.Next().(Data)
+	if d.References[0].Value.String() != "print_string.loop" ||
+		d.References[1].Value.String() != "print_string.done" {
+		t.Fatalf("wrong references: %v", d.References)
+	}
+
+	// Data which begins a statement is a definition, even if it is
+	// upon the same line as something else, and local labels may be
+	// used within it.
+	p = New(`:print_string .table DQ .loop, .done + 8
+  nop .counts DD .done - .loop
+  .repeated times 2 DQ .loop
+  DQ .done`)
+
+	tests = []string{
+		"table: print_string.loop (print_string.done + 8)",
+		"counts: (print_string.done - print_string.loop)",
+		"repeated: print_string.loop",
+		": print_string.done",
+	}
+
+	for _, test := range tests {
+
+		out := p.Next()
+		for {
+			if _, ok := out.(Data); ok {
+				break
+			}
+			if tm, ok := out.(Times); ok {
+				out = tm.Statement
+				continue
+			}
+			if _, ok := out.(Error); ok || out == nil {
+				t.Fatalf("expected data, got %v", out)
+			}
+			out = p.Next()
+		}
+
+		d := out.(Data)
+		got := d.Name + ":"
+		for _, r := range d.References {
+			got += " " + r.Value.String()
+		}
+		if got != test {
+			t.Fatalf("wrong data, expected %s, got %s", test, got)
+		}
+	}
+
+	// Errors
+	for _, test := range []string{":.loop", "jmp .loop", "jmp 1b", ":1\njmp 1f", "jmp 1f\n:2"} {
+
+		p := New(test)
+		out := p.Next()
+		for out != nil {
+			if _, ok := out.(Error); ok {
+				break
+			}
+			out = p.Next()
+		}
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error for '%s'", test)
+		}
+	}
+}
+
+func TestAlign(t *testing.T) {
+
+	p := New(`align 16
+alignb 4 * 2
+.foo DD 1`)
+
+	out := p.Next()
+	a, ok := out.(Align)
+	if !ok || a.Boundary.String() != "16" || a.Zero {
+		t.Fatalf("didn't get align: %v", out)
+	}
+
+	out = p.Next()
+	a, ok = out.(Align)
+	if !ok || a.Boundary.String() != "(4 * 2)" || !a.Zero {
+		t.Fatalf("didn't get alignb: %v", out)
+	}
+
+	// The size of data is recorded, for natural alignment.
+	out = p.Next()
+	d, ok := out.(Data)
+	if !ok || d.Size != 32 {
+		t.Fatalf("wrong data: %v", out)
+	}
+
+	// Errors
+	for _, test := range []string{"align", "alignb", "align rax", "align ("} {
+
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error for '%s', got %v", test, out)
+		}
+	}
+}
+
+func TestDataErrors(t *testing.T) {
+
+	tests := []string{
+		".foo",
+		".foo DB",
+		".foo equ 3",
+		".foo DB 256",
+		".foo DB 0 - 129",
+		".foo DW 65536",
+		".foo DD 4294967296",
+		".foo DB 1, :label",
+		".foo DB rax",
+		".foo DQ \"x\", (",
+		".foo DB 1.5",
+		".foo DW 1.5",
+		".foo DT 1",
+		".foo DD 1e39",
+		".foo DQ 1e309",
+		".foo DT 1e5000",
+		".foo DD -",
+	}
+
+	for _, test := range tests {
+
+		p := New(test)
+		out := p.Next()
+		if _, ok := out.(Error); !ok {
+			t.Fatalf("expected an error for '%s', got %v", test, out)
+		}
+	}
+}
+
+// Test that directives may be used as the names of labels and data.
+func TestDirectiveNames(t *testing.T) {
+
+	p := New(`entry entry
+global times, section
+.times DB 1
+.section DB 2
+.dt DQ 3
+times 2 DB 4
+:entry
+  jmp entry
+  mov rax, times
+  mov rbx, [section + 1]
+  mov rcx, dt * 2`)
+
+	tests := []string{
+		"<ENTRY: name:entry>",
+		"<GLOBAL: names:[times section]>",
+		"<DATA: name:times data:[1]>",
+		"<DATA: name:section data:[2]>",
+		"<DATA: name:dt data:[3 0 0 0 0 0 0 0]>",
+		"<TIMES: count:2 statement:<DATA: name: data:[4]>>",
+		"<LABEL: entry>",
+		"jmp entry",
+		"mov times",
+		"mov section",
+		"mov (dt * 2)",
+	}
+
+	for _, test := range tests {
+
+		out := p.Next()
+		if i, ok := out.(Instruction); ok {
+			got := i.Instruction + " " + i.Operands[len(i.Operands)-1].Literal
+			if got != test {
+				t.Fatalf("wrong instruction, expected %s, got %s", test, got)
+			}
+			continue
+		}
+		if out.String() != test {
+			t.Fatalf("wrong output, expected %s, got %s", test, out)
+		}
+	}
+
+	// The references within the data
+	p = New(`.table DQ entry, dt, times + 1`)
+	d := p.Next().(Data)
+	if len(d.References) != 3 ||
+		d.References[0].Value.String() != "entry" ||
+		d.References[1].Value.String() != "dt" ||
+		d.References[2].Value.String() != "(times + 1)" {
+		t.Fatalf("wrong references: %v", d.References)
+	}
+}
+
+// Test that errors begin with the location of the statement.
+func TestErrorLocation(t *testing.T) {
+
+	p := New("nop\n\nmov rax\nnop")
+	p.Next()
+
+	out := p.Next()
+	e, ok := out.(Error)
+	if !ok || !strings.HasPrefix(e.Value, "input:3: ") {
+		t.Fatalf("expected an error upon line 3, got %v", out)
+	}
+	if p.Location() != "input:3" {
+		t.Fatalf("wrong location, got %s", p.Location())
+	}
+}
+
+// Test that memory-operands which are cut short are errors.
+func TestTruncatedMemory(t *testing.T) {
+
+	for _, test := range []string{"mov rax, [", "mov rax, [rel", "jmp [", "mov rax, qword ptr ["} {
+
+		p := New(test)
+		out := p.Next()
+		e, ok := out.(Error)
+		if !ok || !strings.Contains(e.Value, "unexpected EOF parsing memory-operand") {
+			t.Fatalf("expected an error parsing %s, got %v", test, out)
+		}
+	}
+}
@@ -0,0 +1,861 @@
+// Package preprocessor handles the directives which are carried out
+// before our parser sees the program, such as `%define`, `%if`,
+// `%include`, `%macro`, and `%rep`.
+//
+// The preprocessor consumes the tokens produced by the lexer, and returns
+// a new series of tokens in which the directives have been carried out,
+// any defined names have been replaced by their values, and any macros
+// have been expanded.
+package preprocessor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/skx/assembler/expr"
+	"github.com/skx/assembler/lexer"
+	"github.com/skx/assembler/token"
+)
+
+// conditionals holds the directives which start a conditional block.
+var conditionals = map[string]bool{
+	"%if":     true,
+	"%ifdef":  true,
+	"%ifndef": true,
+}
+
+// macro holds a macro which has been defined via `%macro`.
+type macro struct {
+
+	// min and max hold the number of arguments the macro accepts,
+	// max is -1 if there is no upper limit.
+	min int
+	max int
+
+	// greedy is true if the final parameter takes all the remaining
+	// arguments, including the commas which separate them.
+	greedy bool
+
+	// defaults holds the values of any optional parameters which
+	// are not given.
+	defaults [][]token.Token
+
+	// body holds the lines of the macro.
+	body [][]token.Token
+}
+
+// include records a file which is being included via `%include`.
+type include struct {
+
+	// path holds the path to the file.
+	path string
+
+	// line holds the line of the `%include` which included it.
+	line int
+}
+
+// Preprocessor holds our state.
+type Preprocessor struct {
+
+	// file holds the path to the file we're processing, if known,
+	// which is used to find the files it includes.
+	file string
+
+	// paths holds the directories which are searched for the files
+	// given to `%include`.
+	paths []string
+
+	// includes holds the files we're currently including, with the
+	// innermost last.
+	includes []include
+
+	// sources holds the locations of the lines of the files we've
+	// included.  Until they've been processed completely the lines
+	// are numbered -1, -2, etc, to refer to these.
+	sources []string
+
+	// origins holds the location of each line which we've produced,
+	// for use in error-messages.
+	origins map[int]string
+
+	// defines holds the names, and values, of things which have
+	// been defined via `%define`.
+	defines map[string][]token.Token
+
+	// macros holds the macros which have been defined via `%macro`.
+	macros map[string]*macro
+
+	// expansions counts the macro-expansions we've made, and is
+	// used to give macro-local names, such as `%%loop`, unique names.
+	expansions int
+
+	// active holds the names of the macros we're currently expanding,
+	// a macro used within itself is left alone, just as a name which
+	// is defined in terms of itself is.
+	active map[string]bool
+}
+
+// New creates a new preprocessor.
+func New() *Preprocessor {
+	return &Preprocessor{
+		defines: make(map[string][]token.Token),
+		macros:  make(map[string]*macro),
+		active:  make(map[string]bool),
+	}
+}
+
+// SetFile records the path to the file which is being processed, so
+// that the files it includes may be found relative to it.
+func (p *Preprocessor) SetFile(path string) {
+	p.file = path
+}
+
+// AddIncludePath adds a directory to the list which is searched for the
+// files given to `%include`, if they're not found relative to the file
+// which includes them.
+func (p *Preprocessor) AddIncludePath(dir string) {
+	p.paths = append(p.paths, dir)
+}
+
+// Define defines the given name, as if via `%define`, which allows
+// values to be given upon the command-line.
+func (p *Preprocessor) Define(name string, value string) error {
+
+	toks := lex(name)
+	if len(toks) != 1 || toks[0].Type != token.IDENTIFIER {
+		return fmt.Errorf("invalid name '%s'", name)
+	}
+
+	p.defines[name] = lex(value)
+	return nil
+}
+
+// Process lexes the given input, carries out any directives it contains,
+// and returns the resulting tokens.
+//
+// Errors are reported via ILLEGAL tokens, which the parser will reject.
+// The location of each line of the output, which might be within an
+// included file, is available via Location.
+func (p *Preprocessor) Process(input string) []token.Token {
+
+	var out []token.Token
+	p.sources = nil
+	p.origins = make(map[int]string)
+
+	// The lines of a macro are reported as being upon the line where
+	// the macro was used, but our parser needs to tell each line
+	// apart, so we number any such lines after it.
+	prev := 0
+	for _, line := range p.process(lines(lex(input))) {
+
+		num := line[0].Line
+		if num <= prev {
+			num = prev + 1
+		}
+		prev = num
+
+		if line[0].Line < 0 {
+			p.origins[num] = p.sources[-line[0].Line-1]
+		} else {
+			p.origins[num] = p.location(line[0].Line)
+		}
+
+		for _, tok := range line {
+			tok.Line = num
+			out = append(out, tok)
+		}
+	}
+
+	return out
+}
+
+// process carries out the directives within the given lines, and returns
+// the lines which result.
+func (p *Preprocessor) process(input [][]token.Token) [][]token.Token {
+
+	var out [][]token.Token
+
+	for i := 0; i < len(input); i++ {
+
+		line := input[i]
+		var err error
+
+		switch {
+
+		// A macro definition spans several lines.
+		case line[0].Type == token.DIRECTIVE && line[0].Literal == "%macro":
+			i, err = p.defineMacro(input, i)
+
+		// Only one branch of a conditional is used.
+		case line[0].Type == token.DIRECTIVE && conditionals[line[0].Literal]:
+			var res [][]token.Token
+			res, i, err = p.conditional(input, i)
+			out = append(out, res...)
+
+		// A repeated block is processed as many times as required.
+		case line[0].Type == token.DIRECTIVE && line[0].Literal == "%rep":
+			var res [][]token.Token
+			res, i, err = p.repeat(input, i)
+			out = append(out, res...)
+
+		// An included file is processed in place.
+		case line[0].Type == token.DIRECTIVE && line[0].Literal == "%include":
+			var res [][]token.Token
+			res, err = p.include(line)
+			out = append(out, res...)
+
+		case line[0].Type == token.DIRECTIVE:
+			err = p.directive(line)
+
+		// Other lines have any defined names replaced, and might
+		// be the use of a macro.
+		default:
+			var res [][]token.Token
+			res, err = p.invoke(p.expand(line, make(map[string]bool)))
+			out = append(out, res...)
+		}
+
+		if err != nil {
+			out = append(out, []token.Token{{Type: token.ILLEGAL, Literal: err.Error(), Line: line[0].Line}})
+		}
+	}
+
+	return out
+}
+
+// directive carries out the directive which starts the given line.
+func (p *Preprocessor) directive(line []token.Token) error {
+
+	switch line[0].Literal {
+
+	case "%define":
+		if len(line) < 2 || line[1].Type != token.IDENTIFIER {
+			return fmt.Errorf("expected name after %%define")
+		}
+		p.defines[line[1].Literal] = line[2:]
+		return nil
+
+	case "%assign":
+		if len(line) < 3 || line[1].Type != token.IDENTIFIER {
+			return fmt.Errorf("expected name and value after %%assign")
+		}
+		val, err := p.evaluate(line[1:])
+		if err != nil {
+			return err
+		}
+		p.defines[line[1].Literal] = number(val)
+		return nil
+
+	case "%undef":
+		if len(line) != 2 || line[1].Type != token.IDENTIFIER {
+			return fmt.Errorf("expected name after %%undef")
+		}
+		delete(p.defines, line[1].Literal)
+		return nil
+
+	case "%endmacro":
+		return fmt.Errorf("%%endmacro without %%macro")
+
+	case "%elif", "%elifdef", "%elifndef", "%else", "%endif":
+		return fmt.Errorf("%s without %%if", line[0].Literal)
+
+	case "%endrep":
+		return fmt.Errorf("%%endrep without %%rep")
+	}
+
+	return fmt.Errorf("unknown directive %s", line[0].Literal)
+}
+
+// conditional handles a conditional block, which starts upon the given
+// line, and returns the lines which result from processing the branch
+// which is chosen, along with the line upon which the block ends:
+//
+//   %ifdef DEBUG
+//       ...
+//   %elif LEVEL > 2
+//       ...
+//   %else
+//       ...
+//   %endif
+func (p *Preprocessor) conditional(input [][]token.Token, start int) ([][]token.Token, int, error) {
+
+	var err error
+
+	// Find the start of each branch, and the end of the block.
+	branches := []int{start}
+	depth := 0
+	end := -1
+	for i := start; i < len(input) && end < 0; i++ {
+
+		if input[i][0].Type != token.DIRECTIVE {
+			continue
+		}
+
+		name := input[i][0].Literal
+		switch {
+		case conditionals[name]:
+			depth++
+		case name == "%endif":
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		case depth == 1 && (name == "%else" || strings.HasPrefix(name, "%elif")):
+			if input[branches[len(branches)-1]][0].Literal == "%else" && err == nil {
+				err = fmt.Errorf("%s after %%else", name)
+			}
+			branches = append(branches, i)
+		}
+	}
+	if end < 0 {
+		return nil, len(input) - 1, fmt.Errorf("%s without %%endif", input[start][0].Literal)
+	}
+	if err != nil {
+		return nil, end, err
+	}
+	branches = append(branches, end)
+
+	for n := 0; n < len(branches)-1; n++ {
+		ok, err := p.condition(input[branches[n]])
+		if err != nil {
+			return nil, end, err
+		}
+		if ok {
+			return p.process(input[branches[n]+1 : branches[n+1]]), end, nil
+		}
+	}
+	return nil, end, nil
+}
+
+// condition returns true if the condition upon the given line, which
+// starts a branch of a conditional block, holds.
+func (p *Preprocessor) condition(line []token.Token) (bool, error) {
+
+	name := line[0].Literal
+
+	switch name {
+
+	case "%else":
+		if len(line) != 1 {
+			return false, fmt.Errorf("unexpected %s after %%else", line[1].Literal)
+		}
+		return true, nil
+
+	case "%ifdef", "%elifdef", "%ifndef", "%elifndef":
+		if len(line) != 2 || line[1].Type != token.IDENTIFIER {
+			return false, fmt.Errorf("expected name after %s", name)
+		}
+		_, ok := p.defines[line[1].Literal]
+		if name == "%ifndef" || name == "%elifndef" {
+			return !ok, nil
+		}
+		return ok, nil
+
+	case "%if", "%elif":
+		val, err := p.evaluate(line)
+		return val != 0, err
+	}
+
+	return false, fmt.Errorf("unknown directive %s", name)
+}
+
+// evaluate returns the value of the expression which follows the
+// directive upon the given line.  Any defined names are replaced by
+// their values first, there must be no other names.
+func (p *Preprocessor) evaluate(line []token.Token) (int64, error) {
+
+	toks := p.expand(line[1:], make(map[string]bool))
+	if len(toks) == 0 {
+		return 0, fmt.Errorf("expected expression after %s", line[0].Literal)
+	}
+
+	e, n, err := expr.Parse(toks)
+	if err != nil {
+		return 0, err
+	}
+	if n != len(toks) {
+		return 0, fmt.Errorf("unexpected %s after expression", toks[n].Literal)
+	}
+
+	return expr.Evaluate(e, func(name string) (int64, error) {
+		return 0, fmt.Errorf("%s is not defined", name)
+	})
+}
+
+// repeat handles a block which is repeated, which starts upon the given
+// line, and returns the lines which result from processing it, along with
+// the line upon which the block ends:
+//
+//   %assign i 0
+//   %rep 16
+//       DB i
+//   %assign i i + 1
+//   %endrep
+func (p *Preprocessor) repeat(input [][]token.Token, start int) ([][]token.Token, int, error) {
+
+	end, err := block(input, start, "%rep", "%endrep")
+	if err != nil {
+		return nil, end, err
+	}
+
+	count, err := p.evaluate(input[start])
+	if err != nil {
+		return nil, end, err
+	}
+	if count < 0 {
+		return nil, end, fmt.Errorf("invalid count for %%rep: %d", count)
+	}
+
+	// The body is processed afresh each time, so that it may
+	// use the values assigned within it.
+	var out [][]token.Token
+	for n := int64(0); n < count; n++ {
+		out = append(out, p.process(input[start+1:end])...)
+	}
+	return out, end, nil
+}
+
+// include handles the inclusion of another file, and returns the lines
+// which result from processing it:
+//
+//   %include "syscalls.inc"
+//
+// The lines of the file keep their own locations, which include the
+// location of the `%include`.
+func (p *Preprocessor) include(line []token.Token) ([][]token.Token, error) {
+
+	if len(line) != 2 || line[1].Type != token.STRING {
+		return nil, fmt.Errorf("expected filename after %%include")
+	}
+
+	path, err := p.find(line[1].Literal)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to include a file which is already being processed.
+	chain := []string{p.file}
+	for _, inc := range p.includes {
+		chain = append(chain, inc.path)
+	}
+	for _, name := range chain {
+		if same(name, path) {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), path)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p.includes = append(p.includes, include{path: path, line: line[0].Line})
+	defer func() { p.includes = p.includes[:len(p.includes)-1] }()
+
+	res := p.process(lines(lex(string(data))))
+
+	// Lines which are within this file are numbered so that
+	// they refer to their location.  Those from files which it
+	// included have been numbered already.
+	sources := make(map[int]int)
+	out := make([][]token.Token, len(res))
+	for i, src := range res {
+		for _, tok := range src {
+			if tok.Line > 0 {
+				if _, ok := sources[tok.Line]; !ok {
+					p.sources = append(p.sources, p.location(tok.Line))
+					sources[tok.Line] = -len(p.sources)
+				}
+				tok.Line = sources[tok.Line]
+			}
+			out[i] = append(out[i], tok)
+		}
+	}
+	return out, nil
+}
+
+// find locates a file given to `%include`.  Files are looked for relative
+// to the file which includes them, and then within each of our include
+// paths in turn.
+func (p *Preprocessor) find(name string) (string, error) {
+
+	if filepath.IsAbs(name) {
+		if _, err := os.Stat(name); err != nil {
+			return "", fmt.Errorf("failed to find %s", name)
+		}
+		return name, nil
+	}
+
+	current := p.file
+	if len(p.includes) > 0 {
+		current = p.includes[len(p.includes)-1].path
+	}
+
+	dirs := append([]string{filepath.Dir(current)}, p.paths...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find %s", name)
+}
+
+// Location returns the location, within the source, of the given line of
+// the output of Process, for use in error-messages:
+//
+//   hello.asm:4
+//   syscalls.inc:3 (included from hello.asm:1)
+func (p *Preprocessor) Location(line int) string {
+	return p.origins[line]
+}
+
+// location describes the location of the given line of the file which
+// we're currently processing:
+//
+//   syscalls.inc:3 (included from lib.inc:2, hello.asm:1)
+func (p *Preprocessor) location(line int) string {
+
+	name := p.file
+	if name == "" {
+		name = "input"
+	}
+
+	var chain []string
+	for i := len(p.includes) - 1; i >= 0; i-- {
+		chain = append(chain, fmt.Sprintf("%s:%d", p.includes[i].path, line))
+		line = p.includes[i].line
+	}
+	chain = append(chain, fmt.Sprintf("%s:%d", name, line))
+
+	if len(chain) == 1 {
+		return chain[0]
+	}
+	return chain[0] + " (included from " + strings.Join(chain[1:], ", ") + ")"
+}
+
+// defineMacro handles the definition of a macro, which starts upon the
+// given line, and returns the line upon which the definition ends:
+//
+//   %macro write 2
+//       mov rcx, %1
+//       mov rdx, %2
+//       ...
+//   %endmacro
+//
+// The number of parameters may be given as a range, `1-3`, with the
+// values of the optional parameters following it, or as `1-*` for
+// any number.  A trailing `+` causes the final parameter to receive all
+// the remaining arguments.
+func (p *Preprocessor) defineMacro(input [][]token.Token, start int) (int, error) {
+
+	end, err := block(input, start, "%macro", "%endmacro")
+	if err != nil {
+		return end, err
+	}
+
+	line := input[start]
+	if len(line) < 3 ||
+		(line[1].Type != token.IDENTIFIER && line[1].Type != token.INSTRUCTION) ||
+		line[2].Type != token.NUMBER {
+		return end, fmt.Errorf("expected name and parameter count after %%macro")
+	}
+
+	m := &macro{body: input[start+1 : end]}
+
+	m.min, err = strconv.Atoi(line[2].Literal)
+	if err != nil {
+		return end, fmt.Errorf("invalid parameter count %s", line[2].Literal)
+	}
+	m.max = m.min
+
+	rest := line[3:]
+	if len(rest) >= 2 && rest[0].Type == token.MINUS {
+		switch rest[1].Type {
+		case token.ASTERISK:
+			m.max = -1
+		case token.NUMBER:
+			m.max, err = strconv.Atoi(rest[1].Literal)
+			if err != nil || m.max < m.min {
+				return end, fmt.Errorf("invalid parameter count %s-%s", line[2].Literal, rest[1].Literal)
+			}
+		default:
+			return end, fmt.Errorf("invalid parameter count %s-%s", line[2].Literal, rest[1].Literal)
+		}
+		rest = rest[2:]
+	}
+	if len(rest) >= 1 && rest[0].Type == token.PLUS {
+		if m.max < 1 {
+			return end, fmt.Errorf("a greedy macro must have a final parameter")
+		}
+		m.greedy = true
+		rest = rest[1:]
+	}
+
+	m.defaults = arguments(rest)
+	if m.max >= 0 && len(m.defaults) > m.max-m.min {
+		return end, fmt.Errorf("too many default values for macro %s", line[1].Literal)
+	}
+
+	p.macros[line[1].Literal] = m
+	return end, nil
+}
+
+// invoke expands the macro which is used upon the given line, if any,
+// otherwise the line is returned unchanged.
+func (p *Preprocessor) invoke(line []token.Token) ([][]token.Token, error) {
+
+	var out [][]token.Token
+
+	// A label may precede the use of a macro.
+	for len(line) > 0 && line[0].Type == token.LABEL {
+		out = append(out, line[:1])
+		line = line[1:]
+	}
+	if len(line) == 0 {
+		return out, nil
+	}
+
+	name := line[0]
+	m, ok := p.macros[name.Literal]
+	if !ok || p.active[name.Literal] ||
+		(name.Type != token.IDENTIFIER && name.Type != token.INSTRUCTION) {
+		for _, tok := range line {
+			if tok.Type == token.PARAMETER {
+				return out, fmt.Errorf("%s used outside of a macro", tok.Literal)
+			}
+		}
+		return append(out, line), nil
+	}
+
+	// Work out the values of our parameters.
+	args := arguments(line[1:])
+	count := len(args)
+
+	if m.greedy && count > m.max {
+		last := args[m.max-1]
+		for _, arg := range args[m.max:] {
+			last = append(last, token.Token{Type: token.COMMA, Literal: ","})
+			last = append(last, arg...)
+		}
+		args = append(args[:m.max-1], last)
+		count = m.max
+	}
+	if count < m.min {
+		return out, fmt.Errorf("macro %s expects at least %d arguments, got %d", name.Literal, m.min, count)
+	}
+	if m.max >= 0 && count > m.max {
+		return out, fmt.Errorf("macro %s expects at most %d arguments, got %d", name.Literal, m.max, count)
+	}
+	for len(args) < m.max {
+		var val []token.Token
+		if n := len(args) - m.min; n < len(m.defaults) {
+			val = m.defaults[n]
+		}
+		args = append(args, val)
+	}
+
+	// Each expansion has its own macro-local names.
+	p.expansions++
+	local := fmt.Sprintf("..@%d.", p.expansions)
+
+	var body [][]token.Token
+	for _, src := range m.body {
+
+		var dst []token.Token
+		for _, tok := range src {
+
+			// The lines of the macro appear upon the line where
+			// it was used.
+			tok.Line = name.Line
+
+			switch {
+			case tok.Type == token.PARAMETER && tok.Literal[1] == '%':
+				tok.Type = token.IDENTIFIER
+				tok.Literal = local + tok.Literal[2:]
+
+			case tok.Type == token.PARAMETER:
+				n, err := strconv.Atoi(tok.Literal[1:])
+				if err != nil {
+					return out, fmt.Errorf("invalid macro parameter %s", tok.Literal)
+				}
+				if n == 0 {
+					tok.Type = token.NUMBER
+					tok.Literal = strconv.Itoa(count)
+					break
+				}
+				if n > len(args) {
+					if m.max >= 0 {
+						return out, fmt.Errorf("macro %s has no parameter %s", name.Literal, tok.Literal)
+					}
+					continue
+				}
+				for _, arg := range args[n-1] {
+					arg.Line = name.Line
+					dst = append(dst, arg)
+				}
+				continue
+
+			case (tok.Type == token.LABEL || tok.Type == token.DATA) && len(tok.Literal) > 2 && tok.Literal[:2] == "%%":
+				tok.Literal = local + tok.Literal[2:]
+			}
+
+			dst = append(dst, tok)
+		}
+		if len(dst) > 0 {
+			body = append(body, dst)
+		}
+	}
+
+	// The body may use further macros, or directives.
+	p.active[name.Literal] = true
+	out = append(out, p.process(body)...)
+	delete(p.active, name.Literal)
+
+	return out, nil
+}
+
+// expand replaces any defined names within the given tokens by their
+// values, which are themselves expanded.
+//
+// active holds the names we're currently expanding, so that a name which
+// refers to itself doesn't lead to endless expansion.
+func (p *Preprocessor) expand(toks []token.Token, active map[string]bool) []token.Token {
+
+	var out []token.Token
+
+	for _, tok := range toks {
+
+		val, ok := p.defines[tok.Literal]
+		if tok.Type != token.IDENTIFIER || !ok || active[tok.Literal] {
+			out = append(out, tok)
+			continue
+		}
+
+		// The value appears upon the line where it is used.
+		repl := make([]token.Token, len(val))
+		for i, t := range val {
+			t.Line = tok.Line
+			repl[i] = t
+		}
+
+		active[tok.Literal] = true
+		out = append(out, p.expand(repl, active)...)
+		delete(active, tok.Literal)
+	}
+
+	return out
+}
+
+// lex converts the given input into a series of tokens.
+func lex(input string) []token.Token {
+
+	var toks []token.Token
+
+	l := lexer.New(input)
+	tok := l.NextToken()
+	for tok.Type != token.EOF {
+		toks = append(toks, tok)
+		tok = l.NextToken()
+	}
+	return toks
+}
+
+// lines splits the given tokens into the lines they were found upon.
+func lines(toks []token.Token) [][]token.Token {
+
+	var out [][]token.Token
+
+	for i, tok := range toks {
+		if i == 0 || tok.Line != toks[i-1].Line {
+			out = append(out, nil)
+		}
+		out[len(out)-1] = append(out[len(out)-1], tok)
+	}
+	return out
+}
+
+// block finds the line which closes the block that starts upon the given
+// line, allowing for any blocks nested within it.
+func block(input [][]token.Token, start int, open string, close string) (int, error) {
+
+	depth := 0
+	for i := start; i < len(input); i++ {
+
+		if input[i][0].Type != token.DIRECTIVE {
+			continue
+		}
+		switch input[i][0].Literal {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return len(input) - 1, fmt.Errorf("%s without %s", open, close)
+}
+
+// number returns the tokens which represent the given number.
+func number(val int64) []token.Token {
+
+	if val < 0 {
+		return []token.Token{
+			{Type: token.MINUS, Literal: "-"},
+			{Type: token.NUMBER, Literal: strconv.FormatUint(uint64(-val), 10)},
+		}
+	}
+	return []token.Token{{Type: token.NUMBER, Literal: strconv.FormatInt(val, 10)}}
+}
+
+// arguments splits the given tokens into a comma-separated list of
+// arguments.  Commas within parenthesis don't separate arguments.
+func arguments(toks []token.Token) [][]token.Token {
+
+	if len(toks) == 0 {
+		return nil
+	}
+
+	out := [][]token.Token{nil}
+	depth := 0
+	for _, tok := range toks {
+
+		switch tok.Type {
+		case token.LPAREN:
+			depth++
+		case token.RPAREN:
+			depth--
+		case token.COMMA:
+			if depth == 0 {
+				out = append(out, nil)
+				continue
+			}
+		}
+		out[len(out)-1] = append(out[len(out)-1], tok)
+	}
+	return out
+}
+
+// same returns true if the two paths refer to the same file.
+func same(a string, b string) bool {
+
+	if a == "" || b == "" {
+		return false
+	}
+
+	x, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	y, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(x, y)
+}
@@ -0,0 +1,410 @@
+package preprocessor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/assembler/token"
+)
+
+// join converts the given tokens back into a string, one line per line
+// of input, to make comparisons simple.
+func join(toks []token.Token) string {
+
+	var out []string
+	for _, line := range lines(toks) {
+		var words []string
+		for _, tok := range line {
+			words = append(words, tok.Literal)
+		}
+		out = append(out, strings.Join(words, " "))
+	}
+	return strings.Join(out, "\n")
+}
+
+func TestDefine(t *testing.T) {
+
+	tests := map[string]string{
+		"mov rax, 3":                                "mov rax , 3",
+		"%define FOO 3\nmov rax, FOO":               "mov rax , 3",
+		"%define ARG rdi\nmov ARG, 1":               "mov rdi , 1",
+		"%define A B + 1\n%define B 2\nmov rax, A":  "mov rax , 2 + 1",
+		"%define EMPTY\nmov rax, 1 EMPTY":           "mov rax , 1",
+		"%define SELF SELF + 1\nmov rax, SELF":      "mov rax , SELF + 1",
+		"%define FOO 3\n%undef FOO\nmov rax, FOO":   "mov rax , FOO",
+		"%define FOO 3\n%define FOO 4\npush FOO":    "push 4",
+		"%define SYSCALL int 0x80\nnop\nSYSCALL":    "nop\nint 0x80",
+		"%define FOO 3\n.foo DB FOO, FOO\n:FOO":     "foo DB 3 , 3\nFOO",
+		"%define FOO 3\nmov rax, [rbx + FOO * 2]":   "mov rax , [ rbx + 3 * 2",
+		"%define FOO 3\nFOO_LEN equ FOO\nnop ; FOO": "FOO_LEN equ 3\nnop",
+	}
+
+	for input, expected := range tests {
+
+		p := New()
+		out := p.Process(input)
+
+		if join(out) != expected {
+			t.Fatalf("wrong output for %s, expected '%s' got '%s'", input, expected, join(out))
+		}
+	}
+}
+
+// Test that the value of a define appears upon the line where it is used.
+func TestDefineLines(t *testing.T) {
+
+	p := New()
+	out := p.Process("%define TWO 1 + 1\n\nnop\nmov rax, TWO")
+
+	for _, tok := range out[1:] {
+		if tok.Line != 4 {
+			t.Fatalf("token on wrong line %v", tok)
+		}
+	}
+}
+
+func TestMacro(t *testing.T) {
+
+	tests := map[string]string{
+		"%macro exit 1\nmov rbx, %1\nmov rax, 1\n%endmacro\nexit 3":             "mov rbx , 3\nmov rax , 1",
+		"%macro write 2\nmov rcx, %1\nmov rdx, %2\n%endmacro\nwrite msg, 3 + 4": "mov rcx , msg\nmov rdx , 3 + 4",
+		"%macro two 0\nnop\nnop\n%endmacro\ntwo\ntwo":                           "nop\nnop\nnop\nnop",
+		"%macro count 0-*\npush %0\n%endmacro\ncount 1, 2, 3":                   "push 3",
+		"%macro sum 2\nmov rax, %1 + %2\n%endmacro\nsum (1, 2), 3":              "mov rax , ( 1 , 2 ) + 3",
+		"%macro put 1-3 2, 3\ndb %1, %2, %3\n%endmacro\nput 1":                  "db 1 , 2 , 3",
+		"%macro put 1-3 2, 3\ndb %1, %2, %3\n%endmacro\nput 1, 5":               "db 1 , 5 , 3",
+		"%macro str 1+\n.msg DB %1\n%endmacro\nstr 1, 2, 3":                     "msg DB 1 , 2 , 3",
+		"%macro any 1-*\nmov rax, %1 %2\n%endmacro\nany 1":                      "mov rax , 1",
+		"%macro push 1\npush %1\npush %1\n%endmacro\npush rax":                  "push rax\npush rax",
+		"%macro a 1\nb %1\n%endmacro\n%macro b 1\nmov rax, %1\n%endmacro\na 7":  "mov rax , 7",
+		"%define N 9\n%macro a 0\nmov rax, N\n%endmacro\na":                     "mov rax , 9",
+		"%macro a 0\n%define N 9\n%endmacro\na\nmov rax, N":                     "mov rax , 9",
+		"%macro a 0\nnop\n%endmacro\n:start a":                                  "start\nnop",
+		"%macro say 2\nmov rdx, %2\n%endmacro\nsay \"Hi\\n\", 3":                "mov rdx , 3",
+	}
+
+	for input, expected := range tests {
+
+		p := New()
+		out := p.Process(input)
+
+		if join(out) != expected {
+			t.Fatalf("wrong output for %s, expected '%s' got '%s'", input, expected, join(out))
+		}
+	}
+}
+
+// Test that each expansion of a macro has its own local names.
+func TestMacroLocal(t *testing.T) {
+
+	input := `%macro spin 0
+:%%loop
+jmp %%loop
+%endmacro
+spin
+spin`
+
+	p := New()
+	out := p.Process(input)
+
+	expected := "..@1.loop\njmp ..@1.loop\n..@2.loop\njmp ..@2.loop"
+	if join(out) != expected {
+		t.Fatalf("wrong output, expected '%s' got '%s'", expected, join(out))
+	}
+
+	if out[0].Type != token.LABEL || out[2].Type != token.IDENTIFIER {
+		t.Fatalf("wrong token types: %v", out)
+	}
+}
+
+// Test that the lines of a macro may be told apart.
+func TestMacroLines(t *testing.T) {
+
+	input := `%macro two 0
+nop
+nop
+%endmacro
+two
+nop`
+
+	p := New()
+	out := p.Process(input)
+
+	for i, line := range []int{5, 6, 7} {
+		if out[i].Line != line {
+			t.Fatalf("token %d on wrong line %v", i, out[i])
+		}
+	}
+}
+
+func TestConditional(t *testing.T) {
+
+	tests := map[string]string{
+		"%if 1\nnop\n%endif":             "nop",
+		"%if 0\nnop\n%endif\nret":        "ret",
+		"%if 0\nnop\n%else\nret\n%endif": "ret",
+		"%define A 2\n%if A == 1\nnop\n%elif A == 2\nret\n%else\nleave\n%endif": "ret",
+		"%define A 3\n%if A == 1\nnop\n%elif A == 2\nret\n%else\nleave\n%endif": "leave",
+		"%define A 2\n%if A > 1 && A < 3\nnop\n%endif":                          "nop",
+		"%ifdef A\nnop\n%else\nret\n%endif":                                     "ret",
+		"%define A\n%ifdef A\nnop\n%else\nret\n%endif":                          "nop",
+		"%ifndef A\nnop\n%else\nret\n%endif":                                    "nop",
+		"%define B\n%ifdef A\nnop\n%elifdef B\nret\n%endif":                     "ret",
+		"%if 1\n%if 0\nnop\n%else\nret\n%endif\nleave\n%endif":                  "ret\nleave",
+		"%if 0\n%if 1\nnop\n%endif\n%else\nret\n%endif":                         "ret",
+		"%if 0\n%define A 1\n%endif\n%ifdef A\nnop\n%endif":                     "",
+		"%if 1\n%define A 1\n%endif\n%ifdef A\nnop\n%endif":                     "nop",
+		"%if 0\n%unknown\n%endif":                                               "",
+		"%if 1\n%macro a 0\nnop\n%endmacro\n%endif\na":                          "nop",
+	}
+
+	for input, expected := range tests {
+
+		p := New()
+		out := p.Process(input)
+
+		if join(out) != expected {
+			t.Fatalf("wrong output for %s, expected '%s' got '%s'", input, expected, join(out))
+		}
+	}
+}
+
+func TestRepeat(t *testing.T) {
+
+	tests := map[string]string{
+		"%rep 3\nnop\n%endrep":                                                "nop\nnop\nnop",
+		"%rep 0\nnop\n%endrep\nret":                                           "ret",
+		"%define N 2\n%rep N * 2\nnop\n%endrep":                               "nop\nnop\nnop\nnop",
+		"%assign i 0\n%rep 3\nDB i\n%assign i i + 1\n%endrep":                 "DB 0\nDB 1\nDB 2",
+		"%assign i 3\n%assign i i * i\npush i":                                "push 9",
+		"%assign i 1\n%assign i i - 3\npush i":                                "push - 2",
+		"%rep 2\n%rep 2\nnop\n%endrep\nret\n%endrep":                          "nop\nnop\nret\nnop\nnop\nret",
+		"%assign i 0\n%rep 4\n%if i % 2\nnop\n%endif\n%assign i i+1\n%endrep": "nop\nnop",
+		"%macro twice 1\n%rep 2\n%1\n%endrep\n%endmacro\ntwice ret":           "ret\nret",
+	}
+
+	for input, expected := range tests {
+
+		p := New()
+		out := p.Process(input)
+
+		if join(out) != expected {
+			t.Fatalf("wrong output for %s, expected '%s' got '%s'", input, expected, join(out))
+		}
+	}
+}
+
+// Test that names may be defined by the caller.
+func TestDefineOption(t *testing.T) {
+
+	p := New()
+	if err := p.Define("ABI", "64"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := p.Define("DEBUG", ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := p.Define("rax", "1"); err == nil {
+		t.Fatalf("expected an error defining a register")
+	}
+	if err := p.Define("A B", "1"); err == nil {
+		t.Fatalf("expected an error defining an invalid name")
+	}
+
+	out := p.Process("%if ABI == 64\nsyscall\n%else\nint 0x80\n%endif\n%ifdef DEBUG\nnop\n%endif")
+
+	expected := "syscall\nnop"
+	if join(out) != expected {
+		t.Fatalf("wrong output, expected '%s' got '%s'", expected, join(out))
+	}
+}
+
+// files creates a temporary directory containing the given files.
+func files(t *testing.T, contents map[string]string) string {
+
+	dir, err := ioutil.TempDir("", "preprocessor")
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+
+	for name, data := range contents {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", path, err)
+		}
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+
+	dir := files(t, map[string]string{
+		"main.asm":          "%include \"lib/write.inc\"\nwrite msg\n%include \"exit.inc\"",
+		"lib/write.inc":     "%include \"syscalls.inc\"\n%macro write 1\nmov rcx, %1\nmov rax, SYS_WRITE\n%endmacro",
+		"lib/syscalls.inc":  "%define SYS_WRITE 4",
+		"include/exit.inc":  "mov rax, 1\nint 0x80",
+		"include/other.inc": "nop",
+	})
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "main.asm"))
+	if err != nil {
+		t.Fatalf("failed to read input: %s", err)
+	}
+
+	p := New()
+	p.SetFile(filepath.Join(dir, "main.asm"))
+	p.AddIncludePath(filepath.Join(dir, "include"))
+	out := p.Process(string(data))
+
+	expected := "mov rcx , msg\nmov rax , 4\nmov rax , 1\nint 0x80"
+	if join(out) != expected {
+		t.Fatalf("wrong output, expected '%s' got '%s'", expected, join(out))
+	}
+
+	// Each line keeps its own location.
+	main := filepath.Join(dir, "main.asm")
+	exit := filepath.Join(dir, "include", "exit.inc")
+	locations := []string{
+		main + ":2",
+		main + ":2",
+		exit + ":1 (included from " + main + ":3)",
+		exit + ":2 (included from " + main + ":3)",
+	}
+	var lines []int
+	for i, tok := range out {
+		if i == 0 || tok.Line != out[i-1].Line {
+			lines = append(lines, tok.Line)
+		}
+	}
+	if len(lines) != len(locations) {
+		t.Fatalf("wrong number of lines, got %d", len(lines))
+	}
+	for i, line := range lines {
+		if p.Location(line) != locations[i] {
+			t.Fatalf("wrong location, expected '%s' got '%s'", locations[i], p.Location(line))
+		}
+	}
+
+	// Without the include path the last file can't be found.
+	p = New()
+	p.SetFile(filepath.Join(dir, "main.asm"))
+	out = p.Process(string(data))
+
+	last := out[len(out)-1]
+	if last.Type != token.ILLEGAL || !strings.Contains(last.Literal, "failed to find exit.inc") {
+		t.Fatalf("expected an error, got %v", last)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+
+	dir := files(t, map[string]string{
+		"a.asm": "nop\n%include \"b.inc\"",
+		"b.inc": "\n%include \"a.asm\"",
+		"c.asm": "%include \"d.inc\"",
+		"d.inc": "nop\n%unknown",
+		"e.asm": "%include \"e.asm\"",
+		"f.asm": "%include e.asm",
+		"g.asm": "%include \"missing.inc\"",
+		"h.asm": "%include \"d.inc\" \"d.inc\"",
+		"i.asm": "%include \"j.inc\"",
+		"j.inc": "%include \"d.inc\"",
+	})
+	defer os.RemoveAll(dir)
+
+	tests := map[string]string{
+		"a.asm": "b.inc:2 (included from " + filepath.Join(dir, "a.asm") + ":2): include cycle",
+		"c.asm": "d.inc:2 (included from " + filepath.Join(dir, "c.asm") + ":1): unknown directive %unknown",
+		"e.asm": "include cycle",
+		"f.asm": "expected filename after %include",
+		"g.asm": "failed to find missing.inc",
+		"h.asm": "expected filename after %include",
+		"i.asm": "d.inc:2 (included from " + filepath.Join(dir, "j.inc") + ":1, " + filepath.Join(dir, "i.asm") + ":1): unknown",
+	}
+
+	for name, expected := range tests {
+
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read input: %s", err)
+		}
+
+		p := New()
+		p.SetFile(path)
+		out := p.Process(string(data))
+
+		found := false
+		for _, tok := range out {
+			if tok.Type == token.ILLEGAL && strings.Contains(p.Location(tok.Line)+": "+tok.Literal, expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected error '%s' for %s, got %v", expected, name, out)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+
+	tests := []string{
+		"%define",
+		"%define 3 4",
+		"%undef",
+		"%undef A B",
+		"%unknown directive",
+		"%macro",
+		"%macro foo",
+		"%macro foo 1\nnop",
+		"%macro foo x\n%endmacro",
+		"%macro foo 2-1\n%endmacro",
+		"%macro foo 1-2 3, 4\n%endmacro",
+		"%macro foo 0+\n%endmacro",
+		"%endmacro",
+		"%macro foo 1\n%endmacro\nfoo",
+		"%macro foo 1\n%endmacro\nfoo 1, 2",
+		"%macro foo 1\npush %2\n%endmacro\nfoo 1",
+		"push %1",
+		"%if 1\nnop",
+		"%if\n%endif",
+		"%if 1 2\n%endif",
+		"%if FOO\n%endif",
+		"%if 1 / 0\n%endif",
+		"%ifdef\n%endif",
+		"%ifdef 3\n%endif",
+		"%if 1\n%else\n%else\n%endif",
+		"%if 1\n%else\n%elif 1\n%endif",
+		"%if 0\n%else 1\n%endif",
+		"%elif 1",
+		"%else",
+		"%endif",
+		"%rep 2\nnop",
+		"%rep\n%endrep",
+		"%rep 0 - 1\n%endrep",
+		"%rep FOO\n%endrep",
+		"%endrep",
+		"%assign",
+		"%assign i",
+		"%assign 3 4",
+		"%assign i FOO",
+	}
+
+	for _, input := range tests {
+
+		p := New()
+		out := p.Process(input)
+
+		if len(out) != 1 || out[0].Type != token.ILLEGAL {
+			t.Fatalf("expected an error for %s, got %v", input, out)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+;; This is an example of a jump-table, as might be used to implement
+;; a switch-statement.
+;;
+;; The table holds the addresses of the code for each case, which are
+;; filled in once the program has been laid out.
+;;
+
+.table    DQ case0, case1, case2
+
+;; The strings for each case, and pointers to them.
+.zero     DB "zero\n"
+.one      DB "one\n"
+.two      DB "two\n"
+.strings  DQ zero, one, two
+.lengths  DB one - zero, two - one, strings - two
+
+:start
+        mov rsi, 2                       ;; the case we'll choose
+        jmp qword ptr [table + rsi*8]
+
+:case0
+        mov rbx, 10
+        jmp print
+
+:case1
+        mov rbx, 11
+        jmp print
+
+:case2
+        mov rbx, 12
+
+:print
+        mov rcx, qword ptr [strings + rsi*8]
+        mov rdx, 0
+        mov dl, byte ptr [lengths + rsi]
+        push rbx
+        mov rbx, 1                       ;; write to STDOUT
+        mov rax, 4                       ;; sys_write
+        int 0x80
+
+        pop rbx                          ;; exit with the code for the case
+        mov rax, 1
+        int 0x80
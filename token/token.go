@@ -5,7 +5,12 @@
 // which will then be further-processed.
 package token
 
-import "github.com/skx/assembler/instructions"
+import (
+	"strconv"
+	"strings"
+
+	"github.com/skx/assembler/instructions"
+)
 
 // Type is a string
 type Type string
@@ -18,28 +23,88 @@ type Token struct {
 
 	// Literal contains the literal text of the token.
 	Literal string
+
+	// Line contains the line of the input upon which the token
+	// was found.
+	Line int
 }
 
 // Our known token-types
 const (
 	// Basic things
 	COMMA       = ","
+	COLON       = ":"
+	PLUS        = "+"
+	MINUS       = "-"
+	ASTERISK    = "*"
+	SLASH       = "/"
+	PERCENT     = "%"
+	LSHIFT      = "<<"
+	RSHIFT      = ">>"
+	AMPERSAND   = "&"
+	PIPE        = "|"
+	TILDE       = "~"
+	BANG        = "!"
+	EQ          = "=="
+	NOT_EQ      = "!="
+	LT          = "<"
+	LT_EQUALS   = "<="
+	GT          = ">"
+	GT_EQUALS   = ">="
+	AND         = "&&"
+	OR          = "||"
+	LPAREN      = "("
+	RPAREN      = ")"
 	LSQUARE     = "["
 	RSQUARE     = "]"
 	EOF         = "EOF"
 	LABEL       = "LABEL"
 	DATA        = "DATA"
+	ENCODING    = "ENCODING"
+	DIRECTIVE   = "DIRECTIVE"
+	PARAMETER   = "PARAMETER"
 	REGISTER    = "REGISTER"
+	SEGMENT     = "SEGMENT"
 	INSTRUCTION = "INSTRUCTION"
 	IDENTIFIER  = "IDENTIFIER"
 
-	// Data statement
+	// Data statements
 	DB = "DB"
+	DW = "DW"
+	DD = "DD"
+	DQ = "DQ"
+	DT = "DT"
+
+	// Reservations of uninitialised storage
+	RESB = "RESB"
+	RESW = "RESW"
+	RESD = "RESD"
+	RESQ = "RESQ"
+
+	// Constant definition
+	EQU = "EQU"
+
+	// Repetition
+	TIMES = "TIMES"
+
+	// Section selection
+	SECTION = "SECTION"
+
+	// Alignment
+	ALIGN  = "ALIGN"
+	ALIGNB = "ALIGNB"
+
+	// Entry-point selection
+	ENTRY  = "ENTRY"
+	GLOBAL = "GLOBAL"
 
 	// Number as operand
 	NUMBER = "NUMBER"
 
-	// String for DB
+	// Floating-point number, for data
+	FLOAT = "FLOAT"
+
+	// String for DB, etc
 	STRING = "STRING"
 
 	// Something we couldn't handle
@@ -50,6 +115,42 @@ const (
 var known = map[string]Type{
 	"DB": DB,
 	"db": DB,
+	"DW": DW,
+	"dw": DW,
+	"DD": DD,
+	"dd": DD,
+	"DQ": DQ,
+	"dq": DQ,
+	"DT": DT,
+	"dt": DT,
+
+	"RESB": RESB,
+	"resb": RESB,
+	"RESW": RESW,
+	"resw": RESW,
+	"RESD": RESD,
+	"resd": RESD,
+	"RESQ": RESQ,
+	"resq": RESQ,
+
+	"EQU": EQU,
+	"equ": EQU,
+
+	"TIMES": TIMES,
+	"times": TIMES,
+
+	"SECTION": SECTION,
+	"section": SECTION,
+
+	"ALIGN":  ALIGN,
+	"align":  ALIGN,
+	"ALIGNB": ALIGNB,
+	"alignb": ALIGNB,
+
+	"ENTRY":  ENTRY,
+	"entry":  ENTRY,
+	"GLOBAL": GLOBAL,
+	"global": GLOBAL,
 
 	// Things we parse as registers
 	"rax": REGISTER,
@@ -68,6 +169,101 @@ var known = map[string]Type{
 	"r13": REGISTER,
 	"r14": REGISTER,
 	"r15": REGISTER,
+
+	// 32-bit registers
+	"eax":  REGISTER,
+	"ebx":  REGISTER,
+	"ecx":  REGISTER,
+	"edx":  REGISTER,
+	"ebp":  REGISTER,
+	"esp":  REGISTER,
+	"esi":  REGISTER,
+	"edi":  REGISTER,
+	"r8d":  REGISTER,
+	"r9d":  REGISTER,
+	"r10d": REGISTER,
+	"r11d": REGISTER,
+	"r12d": REGISTER,
+	"r13d": REGISTER,
+	"r14d": REGISTER,
+	"r15d": REGISTER,
+
+	// 16-bit registers
+	"ax":   REGISTER,
+	"bx":   REGISTER,
+	"cx":   REGISTER,
+	"dx":   REGISTER,
+	"bp":   REGISTER,
+	"sp":   REGISTER,
+	"si":   REGISTER,
+	"di":   REGISTER,
+	"r8w":  REGISTER,
+	"r9w":  REGISTER,
+	"r10w": REGISTER,
+	"r11w": REGISTER,
+	"r12w": REGISTER,
+	"r13w": REGISTER,
+	"r14w": REGISTER,
+	"r15w": REGISTER,
+
+	// 8-bit registers
+	"al":   REGISTER,
+	"bl":   REGISTER,
+	"cl":   REGISTER,
+	"dl":   REGISTER,
+	"ah":   REGISTER,
+	"bh":   REGISTER,
+	"ch":   REGISTER,
+	"dh":   REGISTER,
+	"bpl":  REGISTER,
+	"spl":  REGISTER,
+	"sil":  REGISTER,
+	"dil":  REGISTER,
+	"r8b":  REGISTER,
+	"r9b":  REGISTER,
+	"r10b": REGISTER,
+	"r11b": REGISTER,
+	"r12b": REGISTER,
+	"r13b": REGISTER,
+	"r14b": REGISTER,
+	"r15b": REGISTER,
+
+	// Segment registers, which may be used as overrides
+	// in memory-operands, e.g. `mov rax, fs:[0x28]`.
+	"cs": SEGMENT,
+	"ds": SEGMENT,
+	"es": SEGMENT,
+	"fs": SEGMENT,
+	"gs": SEGMENT,
+	"ss": SEGMENT,
+}
+
+// directives holds the keywords which introduce a statement, or part of
+// one.  They're only special where the parser expects a directive, so
+// elsewhere they may be used as the names of labels and data.
+var directives = map[Type]bool{
+	DB:      true,
+	DW:      true,
+	DD:      true,
+	DQ:      true,
+	DT:      true,
+	RESB:    true,
+	RESW:    true,
+	RESD:    true,
+	RESQ:    true,
+	EQU:     true,
+	TIMES:   true,
+	SECTION: true,
+	ALIGN:   true,
+	ALIGNB:  true,
+	ENTRY:   true,
+	GLOBAL:  true,
+}
+
+// IsDirective returns true if the given type is that of a directive,
+// which may also be used as a name.
+func IsDirective(t Type) bool {
+	return directives[t]
 }
 
 // LookupIdentifier used to determinate whether identifier is keyword nor not
@@ -85,3 +281,58 @@ func LookupIdentifier(identifier string) Type {
 	}
 	return IDENTIFIER
 }
+
+// ParseNumber returns the value of the literal of a NUMBER token.
+//
+// Numbers may be given in decimal, with a prefix giving their base, as
+// in `0xff`, `0b1010`, and `0o17`, or with a suffix, as in `0ffh`,
+// `1010b`, `17o`, and `17q`.  Underscores may be used to separate
+// groups of digits, as in `1_000_000`.
+//
+// Large values, such as 0xffffffffffffffff, are accepted as unsigned
+// numbers.
+func ParseNumber(literal string) (int64, error) {
+
+	lit := literal
+	base := 0
+
+	// A hexadecimal suffix takes priority over a prefix, so that
+	// `0bbh` is hexadecimal.
+	hex := len(lit) > 1 && strings.ContainsRune("hH", rune(lit[len(lit)-1]))
+	prefix := !hex && len(lit) > 2 && lit[0] == '0' && strings.ContainsRune("xXbBoO", rune(lit[1]))
+	switch {
+
+	// A suffix gives the base
+	case hex:
+		base = 16
+	case !prefix && len(lit) > 1 && strings.ContainsRune("bB", rune(lit[len(lit)-1])):
+		base = 2
+	case !prefix && len(lit) > 1 && strings.ContainsRune("oOqQ", rune(lit[len(lit)-1])):
+		base = 8
+
+	// Leading zeros don't make a number octal
+	case !prefix && strings.HasPrefix(lit, "0"):
+		base = 10
+	}
+
+	// Remove the suffix, if any.  strconv only accepts underscores
+	// when it finds the base itself.
+	if base != 0 && base != 10 {
+		lit = lit[:len(lit)-1]
+	}
+	if base != 0 {
+		lit = strings.ReplaceAll(lit, "_", "")
+	}
+
+	num, err := strconv.ParseInt(lit, base, 64)
+	if err == nil {
+		return num, nil
+	}
+
+	unum, uerr := strconv.ParseUint(lit, base, 64)
+	if uerr == nil {
+		return int64(unum), nil
+	}
+
+	return 0, err
+}
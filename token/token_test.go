@@ -21,3 +21,49 @@ func TestLookup(t *testing.T) {
 		}
 	}
 }
+
+// Test converting numbers, in their various forms
+func TestParseNumber(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		result int64
+	}{
+		{"0", 0},
+		{"42", 42},
+		{"010", 10},
+		{"-1", -1},
+		{"0xff", 255},
+		{"0XFF", 255},
+		{"0b1010", 10},
+		{"0o17", 15},
+		{"0ffh", 255},
+		{"0FFH", 255},
+		{"0bbh", 187},
+		{"1010b", 10},
+		{"17o", 15},
+		{"17q", 15},
+		{"1_000_000", 1000000},
+		{"0xffff_ffff", 4294967295},
+		{"1111_0000b", 240},
+		{"0xffffffffffffffff", -1},
+	}
+
+	for _, test := range tests {
+		out, err := ParseNumber(test.input)
+		if err != nil {
+			t.Fatalf("unexpected error converting %s: %s", test.input, err)
+		}
+		if out != test.result {
+			t.Fatalf("wrong result for %s, expected %d, got %d", test.input, test.result, out)
+		}
+	}
+
+	// Errors
+	for _, test := range []string{"", "0x", "12f", "102b", "19o", "0x1g", "1__0", "0x10000000000000000"} {
+		_, err := ParseNumber(test)
+		if err == nil {
+			t.Fatalf("expected an error converting %s", test)
+		}
+	}
+}